@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/epokhe/bitdb/core"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  bitdb-inspect segments -path <data-dir> [-json]\n")
+	fmt.Fprintf(os.Stderr, "  bitdb-inspect dump -path <data-dir> -segment <id> [-json]\n")
+	fmt.Fprintf(os.Stderr, "  bitdb-inspect ratio -path <data-dir> [-json]\n")
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	action := os.Args[1]
+
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	var (
+		dbPath = fs.String("path", "", "path to data directory")
+		segId  = fs.Int("segment", 0, "id of the segment to dump")
+		asJSON = fs.Bool("json", false, "print JSON, one object per line")
+	)
+	_ = fs.Parse(os.Args[2:])
+
+	if *dbPath == "" {
+		usage()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	enc := json.NewEncoder(os.Stdout)
+
+	// text output is a table, JSON output is one object per line
+	header := func(h string) {
+		if !*asJSON {
+			fmt.Fprintln(w, h)
+		}
+	}
+
+	switch action {
+	case "segments":
+		segs, err := core.ListSegments(*dbPath)
+		if err != nil {
+			log.Fatalf("failed to list segments: %v", err)
+		}
+
+		header("ID\tFILE\tSIZE\tRECORDS\tGEN\tVERSION\tSTATE")
+		for _, s := range segs {
+			if *asJSON {
+				_ = enc.Encode(s)
+				continue
+			}
+
+			state := "active"
+			if s.Sealed {
+				state = "sealed"
+			}
+			if s.Merged {
+				state += ",merged"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\t%s\n", s.Id, s.File, s.Size, s.Records, s.Generation, s.Version, state)
+		}
+
+	case "dump":
+		if *segId == 0 {
+			usage()
+		}
+
+		header("OFFSET\tLENGTH\tTYPE\tKEY\tVALUE LEN\tCHECKSUM")
+		err := core.DumpSegment(*dbPath, *segId, func(r core.RecordInfo) error {
+			if *asJSON {
+				return enc.Encode(r)
+			}
+			_, err := fmt.Fprintf(w, "%d\t%d\t%s\t%q\t%d\t%s\n", r.Offset, r.Length, r.Type, r.Key, r.ValueLen, r.Status)
+			return err
+		})
+		if err != nil {
+			_ = w.Flush()
+			log.Fatalf("failed to dump segment %d: %v", *segId, err)
+		}
+
+	case "ratio":
+		segUsage, err := core.ListSegmentUsage(*dbPath)
+		if err != nil {
+			log.Fatalf("failed to compute segment usage: %v", err)
+		}
+
+		header("ID\tRECORDS\tLIVE\tBYTES\tLIVE BYTES\tLIVE RATIO")
+		for _, u := range segUsage {
+			if *asJSON {
+				_ = enc.Encode(u)
+				continue
+			}
+
+			ratio := 0.0
+			if u.Bytes > 0 {
+				ratio = float64(u.LiveBytes) / float64(u.Bytes)
+			}
+			fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%.2f\n", u.Id, u.Records, u.Live, u.Bytes, u.LiveBytes, ratio)
+		}
+
+	default:
+		usage()
+	}
+
+	_ = w.Flush()
+}
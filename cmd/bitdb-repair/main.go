@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/epokhe/bitdb/core"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  bitdb-repair -path <data-dir> -out <output-dir>\n")
+	fmt.Fprintf(os.Stderr, "  bitdb-repair -path <data-dir> -in-place\n")
+	os.Exit(1)
+}
+
+func main() {
+	var (
+		dbPath  = flag.String("path", "", "path to data directory")
+		outPath = flag.String("out", "", "directory to write the repaired database to")
+		inPlace = flag.Bool("in-place", false, "replace the data directory, keeping the original as <data-dir>.pre-repair")
+		guess   = flag.Bool("guess-order", false, "guess the segment order if the MANIFEST is unusable, stale values may win")
+	)
+	flag.Parse()
+
+	if *dbPath == "" || (*outPath == "") == !*inPlace {
+		usage()
+	}
+
+	dir := filepath.Clean(*dbPath)
+
+	// in place, the repair is written next to the data directory and swapped in at the end
+	dst := *outPath
+	if *inPlace {
+		dst = dir + ".repair"
+		if err := os.RemoveAll(dst); err != nil {
+			log.Fatalf("could not remove leftover %s: %v", dst, err)
+		}
+	}
+
+	rep, err := core.Repair(dir, dst, core.RepairOptions{GuessOrder: *guess})
+	if err != nil {
+		log.Fatalf("repair failed: %v", err)
+	}
+
+	if *inPlace {
+		backup := dir + ".pre-repair"
+		if _, err := os.Stat(backup); err == nil {
+			log.Fatalf("%s already exists, repaired database is left in %s", backup, dst)
+		}
+
+		if err := os.Rename(dir, backup); err != nil {
+			log.Fatalf("could not move %s to %s: %v", dir, backup, err)
+		}
+		if err := os.Rename(dst, dir); err != nil {
+			log.Fatalf("could not move %s to %s, original is in %s: %v", dst, dir, backup, err)
+		}
+		log.Printf("original data directory is kept in %s", backup)
+		dst = dir
+	}
+
+	fmt.Printf("segments:  %d\n", rep.Segments)
+	fmt.Printf("recovered: %d records\n", rep.Recovered)
+	if rep.GuessedOrder {
+		fmt.Printf("order:     guessed, the MANIFEST was unusable\n")
+	}
+	fmt.Printf("lost:      %d regions, %d bytes\n", len(rep.Lost), rep.LostBytes)
+	for _, c := range rep.Lost {
+		fmt.Printf("  segment %d [%d, %d): %v\n", c.Segment, c.Offset, c.Offset+c.Length, c.Err)
+	}
+	if rep.TornBytes > 0 {
+		fmt.Printf("torn:      %d bytes of an unacknowledged write\n", rep.TornBytes)
+	}
+	fmt.Printf("repaired database is in %s\n", dst)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/epokhe/bitdb/core"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  bitdb verify <data-dir>\n")
+	fmt.Fprintf(os.Stderr, "  bitdb export [-format jsonl|csv] [-base64] [-out <file>] <data-dir>\n")
+	fmt.Fprintf(os.Stderr, "  bitdb import [-format jsonl|csv] [-base64] [-in <file>] <data-dir>\n")
+	fmt.Fprintf(os.Stderr, "  bitdb restore -at <RFC3339 time> <data-dir> <dest-dir>\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	action := os.Args[1]
+
+	switch action {
+	case "verify":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		verify(os.Args[2])
+
+	case "export", "import":
+		fs := flag.NewFlagSet(action, flag.ExitOnError)
+		var (
+			format = fs.String("format", "jsonl", "jsonl or csv")
+			b64    = fs.Bool("base64", false, "base64 encode keys and values, for binary data")
+			file   string
+		)
+		if action == "export" {
+			fs.StringVar(&file, "out", "", "file to export to, stdout if empty")
+		} else {
+			fs.StringVar(&file, "in", "", "file to import from, stdin if empty")
+		}
+		_ = fs.Parse(os.Args[2:])
+
+		if fs.NArg() != 1 {
+			usage()
+		}
+
+		opts := core.TextOptions{Format: core.TextFormat(*format), Base64: *b64}
+		run := importText
+		if action == "export" {
+			run = export
+		}
+		if err := run(fs.Arg(0), file, opts); err != nil {
+			log.Fatal(err)
+		}
+
+	case "restore":
+		fs := flag.NewFlagSet(action, flag.ExitOnError)
+		at := fs.String("at", "", "point in time to restore, e.g. 2024-05-01T12:00:00Z")
+		_ = fs.Parse(os.Args[2:])
+
+		if *at == "" || fs.NArg() != 2 {
+			usage()
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, *at)
+		if err != nil {
+			log.Fatalf("invalid time %q: %v", *at, err)
+		}
+
+		if err := core.RestoreAt(fs.Arg(0), fs.Arg(1), t); err != nil {
+			log.Fatalf("failed to restore %s as of %s: %v", fs.Arg(0), *at, err)
+		}
+
+	default:
+		usage()
+	}
+}
+
+// verify exits with 1 if the data directory has problems
+func verify(dir string) {
+	rep, err := core.Verify(dir)
+	if err != nil {
+		log.Fatalf("failed to verify %s: %v", dir, err)
+	}
+
+	fmt.Printf("segments: %d\n", rep.Segments)
+	fmt.Printf("records:  %d\n", rep.Records)
+	fmt.Printf("keys:     %d\n", rep.Keys)
+
+	if rep.OK() {
+		fmt.Println("ok")
+		return
+	}
+
+	fmt.Printf("%d problems:\n", len(rep.Problems))
+	for _, p := range rep.Problems {
+		fmt.Printf("  %v\n", p)
+	}
+	os.Exit(1)
+}
+
+// export writes the keys of dir to file. Errors are returned, not fatal,
+// so the deferred closes run first.
+func export(dir, file string, opts core.TextOptions) (rerr error) {
+	db, err := core.Open(dir, core.WithMergeEnabled(false))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil && rerr == nil {
+			rerr = fmt.Errorf("failed to close %s: %w", dir, err)
+		}
+	}()
+
+	var w io.Writer = os.Stdout
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", file, err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil && rerr == nil {
+				rerr = fmt.Errorf("failed to write %s: %w", file, err)
+			}
+		}()
+		w = f
+	}
+
+	if err := db.ExportText(w, opts); err != nil {
+		return fmt.Errorf("failed to export %s: %w", dir, err)
+	}
+	return nil
+}
+
+func importText(dir, file string, opts core.TextOptions) error {
+	var r io.Reader = os.Stdin
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", file, err)
+		}
+		defer f.Close() // nolint:errcheck
+		r = f
+	}
+
+	db, err := core.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+
+	n, err := db.ImportText(r, opts)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to import into %s after %d keys: %w", dir, n, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", n)
+	return nil
+}
@@ -0,0 +1,287 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zeebo/xxh3"
+)
+
+// An archive holds the live keys of a database in a single file, for shipping
+// data between environments. It's written by Export and read by Import.
+//
+// Layout (little endian, varints are unsigned):
+//
+//	[8-byte magic][2-byte version]
+//	{ [4-byte payload length][8-byte checksum of payload][payload] } ...
+//
+// Payload is a 1-byte frame type followed by the frame:
+//
+//	info:  [varint created at, unix nanos]                     first frame
+//	entry: [varint keyLen][key][varint valLen][val]            one per key, sorted by key
+//	end:   [varint key count]                                  last frame
+//
+// The end frame tells a complete archive from a truncated one. Payloads are
+// at most maxArchiveFrame bytes, so a damaged length can't make the reader
+// allocate gigabytes.
+const archiveVersion = 1
+
+const maxArchiveFrame = 256 << 20
+
+var archiveMagic = []byte("BITDBARC")
+
+var ErrArchiveCorrupt = errors.New("archive corrupt")
+
+const (
+	frameInfo byte = iota + 1
+	frameEntry
+	frameEnd
+)
+
+// Export writes an archive of the live keys to w. Writes can go on meanwhile,
+// the archive has the keys as they were when Export was called. It fails on
+// a key and value larger than maxArchiveFrame together.
+func (db *DB) Export(w io.Writer) error {
+	aw := newArchiveWriter(w)
+	aw.frame(frameInfo, func(buf []byte) []byte {
+		return binary.AppendUvarint(buf, uint64(time.Now().UnixNano()))
+	})
+
+	var count uint64
+	err := db.forEachLive(func(key, val string) error {
+		aw.frame(frameEntry, func(buf []byte) []byte {
+			buf = binary.AppendUvarint(buf, uint64(len(key)))
+			buf = append(buf, key...)
+			buf = binary.AppendUvarint(buf, uint64(len(val)))
+			return append(buf, val...)
+		})
+		count++
+		return aw.err
+	})
+	if err != nil {
+		return err
+	}
+
+	aw.frame(frameEnd, func(buf []byte) []byte {
+		return binary.AppendUvarint(buf, count)
+	})
+
+	return aw.flush()
+}
+
+// forEachLive calls fn for each live key in key order, with the keys as they
+// were when it was called. Writes can go on meanwhile. It stops at the
+// first error fn returns.
+func (db *DB) forEachLive(fn func(key, val string) error) error {
+	type entry struct {
+		key string
+		loc recordLocation
+	}
+
+	// pin first, so the segments the snapshot points to
+	// are kept around even if they're merged away
+	db.pinSegments()
+	defer db.unpinSegments()
+
+	db.rw.RLock()
+	entries := make([]entry, 0, db.index.len())
+	db.index.forEach(func(key string, loc recordLocation) bool {
+		entries = append(entries, entry{key, loc})
+		return true
+	})
+	db.rw.RUnlock()
+
+	slices.SortFunc(entries, func(a, b entry) int { return strings.Compare(a.key, b.key) })
+
+	files := make(map[uint32]*os.File)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	for _, e := range entries {
+		f, ok := files[e.loc.segId]
+		if !ok {
+			var err error
+			if f, err = os.Open(getSegmentPath(db.dir, int(e.loc.segId))); err != nil {
+				return fmt.Errorf("open segment %d: %w", e.loc.segId, err)
+			}
+			files[e.loc.segId] = f
+		}
+
+		val, wt, err := readRecord(f, e.loc.offset, db.checksumEnabled)
+		if err != nil {
+			return fmt.Errorf("read key %q: %w", e.key, err)
+		}
+		if wt == TypeDelete {
+			// same as Get, the key isn't live
+			continue
+		}
+
+		if err := fn(e.key, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import restores an archive written by Export into a new database in dir,
+// which must not exist or be empty. It's written with a SegmentWriter, opts
+// are passed to it. If it fails, dir is left incomplete and should be removed.
+func Import(dir string, r io.Reader, opts ...WriterOption) error {
+	w, err := NewSegmentWriter(dir, opts...)
+	if err != nil {
+		return err
+	}
+
+	if err := readArchive(r, w.Add); err != nil {
+		return errors.Join(err, w.Abort())
+	}
+
+	return w.Close()
+}
+
+// readArchive verifies the archive in r and calls fn for each of its keys
+func readArchive(r io.Reader, fn func(key, val string) error) error {
+	ar := newArchiveReader(r)
+	if err := ar.readHeader(); err != nil {
+		return err
+	}
+
+	var count uint64
+	for {
+		typ, p, err := ar.next()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameEntry:
+			key := string(p.bytes(p.uvarint()))
+			val := string(p.bytes(p.uvarint()))
+			if p.err != nil {
+				return fmt.Errorf("%w: entry %d: %w", ErrArchiveCorrupt, count, p.err)
+			}
+			if err := fn(key, val); err != nil {
+				return err
+			}
+			count++
+		case frameEnd:
+			if n := p.uvarint(); p.err != nil || n != count {
+				return fmt.Errorf("%w: archive has %d keys, end says %d", ErrArchiveCorrupt, count, n)
+			}
+			return nil
+		default:
+			return fmt.Errorf("%w: unexpected frame type %d", ErrArchiveCorrupt, typ)
+		}
+	}
+}
+
+type archiveWriter struct {
+	w   *bufio.Writer
+	buf []byte
+	err error
+}
+
+func newArchiveWriter(w io.Writer) *archiveWriter {
+	aw := &archiveWriter{w: bufio.NewWriter(w)}
+	hdr := binary.LittleEndian.AppendUint16(append([]byte(nil), archiveMagic...), archiveVersion)
+	_, aw.err = aw.w.Write(hdr)
+	return aw
+}
+
+// frame writes a frame of typ with the payload appended by fill, it keeps the first error
+func (aw *archiveWriter) frame(typ byte, fill func(buf []byte) []byte) {
+	if aw.err != nil {
+		return
+	}
+
+	aw.buf = fill(append(aw.buf[:0], typ))
+	if len(aw.buf) > maxArchiveFrame {
+		aw.err = fmt.Errorf("frame of %d bytes is over the %d limit", len(aw.buf), maxArchiveFrame)
+		return
+	}
+	_, aw.err = aw.w.Write(appendEdit(nil, aw.buf))
+}
+
+func (aw *archiveWriter) flush() error {
+	if aw.err != nil {
+		return fmt.Errorf("write archive: %w", aw.err)
+	}
+	if err := aw.w.Flush(); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	return nil
+}
+
+type archiveReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newArchiveReader(r io.Reader) *archiveReader {
+	return &archiveReader{r: bufio.NewReader(r)}
+}
+
+// readHeader checks the magic and the version, and reads the info frame
+func (ar *archiveReader) readHeader() error {
+	var hdr [10]byte
+	if _, err := io.ReadFull(ar.r, hdr[:]); err != nil || string(hdr[:len(archiveMagic)]) != string(archiveMagic) {
+		return fmt.Errorf("%w: not an archive", ErrArchiveCorrupt)
+	}
+
+	if v := binary.LittleEndian.Uint16(hdr[len(archiveMagic):]); v != archiveVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrArchiveCorrupt, v)
+	}
+
+	typ, _, err := ar.next()
+	if err != nil {
+		return err
+	}
+	if typ != frameInfo {
+		return fmt.Errorf("%w: missing info frame", ErrArchiveCorrupt)
+	}
+
+	return nil
+}
+
+// next reads the next frame and verifies its checksum. The payload
+// reader is only valid until the next call.
+func (ar *archiveReader) next() (byte, *byteReader, error) {
+	var frame [manifestFrameLen]byte
+	if _, err := io.ReadFull(ar.r, frame[:]); err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated: %w", ErrArchiveCorrupt, err)
+	}
+
+	n := binary.LittleEndian.Uint32(frame[:])
+	if n == 0 {
+		return 0, nil, fmt.Errorf("%w: empty frame", ErrArchiveCorrupt)
+	}
+	if n > maxArchiveFrame {
+		return 0, nil, fmt.Errorf("%w: frame of %d bytes is over the %d limit", ErrArchiveCorrupt, n, maxArchiveFrame)
+	}
+
+	if cap(ar.buf) < int(n) {
+		ar.buf = make([]byte, n)
+	}
+	payload := ar.buf[:n]
+	if _, err := io.ReadFull(ar.r, payload); err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated: %w", ErrArchiveCorrupt, err)
+	}
+
+	sum := binary.LittleEndian.Uint64(frame[4:])
+	if computed := xxh3.Hash(payload); computed != sum {
+		return 0, nil, fmt.Errorf("%w: %w: expected %x, got %x", ErrArchiveCorrupt, ErrChecksumMismatch, sum, computed)
+	}
+
+	return payload[0], &byteReader{buf: payload[1:]}, nil
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithRolloverThreshold(100), WithMergeEnabled(false))
+	for i := range 20 {
+		_ = db.Set(fmt.Sprintf("k%02d", i), "old")
+	}
+	for i := range 10 {
+		_ = db.Set(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i))
+	}
+	_ = db.Delete("k15")
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	archive := buf.Bytes()
+
+	dir := filepath.Join(t.TempDir(), "imported")
+	if err := Import(dir, bytes.NewReader(archive)); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	db2, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open imported: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	// only the live keys are imported
+	if st := db2.Stats(); st.Keys != 19 {
+		t.Fatalf("unexpected stats of the import: %+v", st)
+	}
+	for key, val := range map[string]string{"k03": "v3", "k12": "old"} {
+		if v, err := db2.Get(key); err != nil || v != val {
+			t.Fatalf("expected %s=%s, got %q, %v", key, val, v, err)
+		}
+	}
+	if _, err := db2.Get("k15"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected k15 to be deleted, got %v", err)
+	}
+
+	if err := Import(dir, bytes.NewReader(archive)); err == nil {
+		t.Fatalf("expected import into a non-empty directory to fail")
+	}
+
+	for name, damaged := range map[string][]byte{
+		"truncated":      archive[:len(archive)-5],
+		"corrupted":      append(append([]byte(nil), archive[:40]...), append([]byte{archive[40] ^ 0xff}, archive[41:]...)...),
+		"not an archive": []byte("hello"),
+		"huge frame":     append(append([]byte(nil), archive[:10]...), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0),
+	} {
+		err := Import(filepath.Join(t.TempDir(), "damaged"), bytes.NewReader(damaged))
+		if !errors.Is(err, ErrArchiveCorrupt) {
+			t.Fatalf("%s: expected a corrupt archive, got %v", name, err)
+		}
+	}
+}
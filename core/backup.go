@@ -0,0 +1,372 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// backupView is the segment list a backup copies, frozen when the backup starts
+type backupView struct {
+	metas      []segmentMeta // manifest entries, the last one is the active segment
+	activeSize int64         // size of the active segment when the view was taken
+}
+
+// Every backup directory has a BACKUP file that describes it. Backups form
+// chains: a full backup is the base, and each incremental backup refers to the
+// backup it's based on as its parent. The BACKUP file lists all segments of the
+// database as of the backup, along with the part of each one that's stored in
+// this backup's directory. Segments are immutable once sealed and only grow
+// while active, so a segment is the concatenation of its parts along the chain.
+const backupInfoName = "BACKUP"
+
+var ErrBackupChain = errors.New("invalid backup chain")
+
+// backupInfo is the content of the BACKUP file
+type backupInfo struct {
+	Id        string          `json:"id"`
+	Parent    string          `json:"parent,omitempty"` // empty for a full backup
+	CreatedAt time.Time       `json:"created_at"`
+	Segments  []backupSegment `json:"segments"` // MANIFEST order, the last one is active
+}
+
+// backupSegment is a segment in a backup. Bytes [Start, Size) of the segment
+// are stored in the backup directory, the rest is in the parent backups.
+type backupSegment struct {
+	Id         int   `json:"id"`
+	Size       int64 `json:"size"`
+	Start      int64 `json:"start"`
+	Records    int64 `json:"records"` // 0 for the active segment
+	Generation int   `json:"generation"`
+	Flags      uint8 `json:"flags"`
+}
+
+func (bs backupSegment) meta() segmentMeta {
+	m := segmentMeta{id: bs.Id, records: bs.Records, generation: bs.Generation, flags: bs.Flags}
+	if m.sealed() {
+		m.size = bs.Size
+	}
+	return m
+}
+
+// BackupToken identifies a backup, and what it holds, for incremental backups
+type BackupToken struct {
+	id    string
+	sizes map[int]int64 // segment sizes by id
+}
+
+func (bi *backupInfo) token() BackupToken {
+	t := BackupToken{id: bi.Id, sizes: make(map[int]int64, len(bi.Segments))}
+	for _, bs := range bi.Segments {
+		t.sizes[bs.Id] = bs.Size
+	}
+	return t
+}
+
+// ReadBackupToken returns the token of the backup in dir
+func ReadBackupToken(dir string) (BackupToken, error) {
+	bi, err := readBackupInfo(dir)
+	if err != nil {
+		return BackupToken{}, err
+	}
+	return bi.token(), nil
+}
+
+func readBackupInfo(dir string) (*backupInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, backupInfoName))
+	if err != nil {
+		return nil, fmt.Errorf("read backup info: %w", err)
+	}
+
+	var bi backupInfo
+	if err := json.Unmarshal(data, &bi); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrBackupChain, dir, err)
+	}
+	return &bi, nil
+}
+
+// Backup copies a consistent snapshot of the database to dest, which must not
+// exist or be empty, while reads and writes go on. The snapshot has every write
+// acknowledged before Backup was called. Inactive segments are immutable, so
+// they're hard linked when possible and copied otherwise, and the active segment
+// is copied up to its size at the start. Merges that complete meanwhile keep
+// the files of their input segments until the backup is done.
+//
+// dest is a complete data directory, it can be opened with Open. The returned
+// token is the base for BackupIncremental.
+func (db *DB) Backup(dest string) (BackupToken, error) {
+	return db.backup(dest, BackupToken{})
+}
+
+// BackupIncremental is Backup that only copies what changed since the backup
+// of the since token: segments created after it, and what's appended to the
+// segment that was active at the time. dest can't be opened, RestoreBackup
+// reconstructs a data directory from the backup chain.
+func (db *DB) BackupIncremental(dest string, since BackupToken) (BackupToken, error) {
+	if since.id == "" {
+		return BackupToken{}, fmt.Errorf("%w: empty token", ErrBackupChain)
+	}
+	return db.backup(dest, since)
+}
+
+func (db *DB) backup(dest string, since BackupToken) (BackupToken, error) {
+	if err := createEmptyDir(dest); err != nil {
+		return BackupToken{}, err
+	}
+
+	view := db.pinSegments()
+	defer db.unpinSegments()
+
+	bi := &backupInfo{Id: newBackupId(), Parent: since.id, CreatedAt: time.Now()}
+
+	for i, m := range view.metas {
+		isActive := i == len(view.metas)-1
+
+		bs := backupSegment{Id: m.id, Size: m.size, Records: m.records, Generation: m.generation, Flags: m.flags}
+		if isActive {
+			bs.Size = view.activeSize
+		}
+
+		// segments only grow, the parent has a prefix of this one
+		if prev, ok := since.sizes[m.id]; ok {
+			if prev > bs.Size {
+				return BackupToken{}, fmt.Errorf("%w: segment %d shrank from %d to %d bytes", ErrBackupChain, m.id, prev, bs.Size)
+			}
+			bs.Start = prev
+		}
+
+		src, dst := getSegmentPath(db.dir, m.id), getSegmentPath(dest, m.id)
+
+		var err error
+		switch {
+		case bs.Start == bs.Size:
+			// nothing new
+		case bs.Start == 0 && !isActive:
+			err = linkOrCopyFile(src, dst, bs.Size)
+		default:
+			err = copyFile(src, dst, bs.Start, bs.Size)
+		}
+		if err != nil {
+			return BackupToken{}, fmt.Errorf("backup segment %d: %w", m.id, err)
+		}
+
+		bi.Segments = append(bi.Segments, bs)
+	}
+
+	data, err := json.MarshalIndent(bi, "", "  ")
+	if err != nil {
+		return BackupToken{}, fmt.Errorf("encode backup info: %w", err)
+	}
+
+	if err := replaceFileAtomic(filepath.Join(dest, backupInfoName), data); err != nil {
+		return BackupToken{}, fmt.Errorf("write backup info: %w", err)
+	}
+
+	// a full backup is a data directory. the manifest is written
+	// last, and it makes the segments durable too
+	if since.id == "" {
+		if err := replaceFileAtomic(filepath.Join(dest, manifestName), encodeManifestSnapshot(view.metas)); err != nil {
+			return BackupToken{}, fmt.Errorf("write manifest: %w", err)
+		}
+	}
+
+	return bi.token(), nil
+}
+
+// RestoreBackup reconstructs the database of a backup chain into dest, which
+// must not exist or be empty. The chain is the full backup followed by the
+// incremental backups based on it, in order. It's restored as of the last one.
+func RestoreBackup(dest string, chain ...string) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: no backups", ErrBackupChain)
+	}
+
+	infos := make([]*backupInfo, len(chain))
+	for i, dir := range chain {
+		bi, err := readBackupInfo(dir)
+		if err != nil {
+			return err
+		}
+
+		parent := ""
+		if i > 0 {
+			parent = infos[i-1].Id
+		}
+		if bi.Parent != parent {
+			return fmt.Errorf("%w: %s is based on backup %q, expected %q", ErrBackupChain, dir, bi.Parent, parent)
+		}
+		infos[i] = bi
+	}
+
+	if err := createEmptyDir(dest); err != nil {
+		return err
+	}
+
+	last := infos[len(infos)-1]
+	metas := make([]segmentMeta, len(last.Segments))
+
+	for i, bs := range last.Segments {
+		if err := restoreSegment(dest, bs, chain, infos); err != nil {
+			return fmt.Errorf("restore segment %d: %w", bs.Id, err)
+		}
+		metas[i] = bs.meta()
+	}
+
+	if err := replaceFileAtomic(filepath.Join(dest, manifestName), encodeManifestSnapshot(metas)); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// restoreSegment concatenates the parts of segment bs stored along the chain
+func restoreSegment(dest string, bs backupSegment, chain []string, infos []*backupInfo) (rerr error) {
+	out, err := os.OpenFile(getSegmentPath(dest, bs.Id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := out.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	var size int64
+	for i, bi := range infos {
+		j := slices.IndexFunc(bi.Segments, func(s backupSegment) bool { return s.Id == bs.Id })
+		if j < 0 {
+			continue
+		}
+
+		part := bi.Segments[j]
+		if part.Start == part.Size {
+			continue
+		}
+		if part.Start != size {
+			return fmt.Errorf("%w: %s has bytes from %d, expected %d", ErrBackupChain, chain[i], part.Start, size)
+		}
+
+		if err := appendFile(out, getSegmentPath(chain[i], bs.Id), part.Size-part.Start); err != nil {
+			return err
+		}
+		size = part.Size
+	}
+
+	if size != bs.Size {
+		return fmt.Errorf("%w: found %d of %d bytes", ErrBackupChain, size, bs.Size)
+	}
+
+	return out.Sync()
+}
+
+// appendFile appends n bytes of the file at path to out
+func appendFile(out *os.File, path string, n int64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint:errcheck
+
+	if _, err := io.CopyN(out, in, n); err != nil {
+		return fmt.Errorf("copy %s: %w", path, err)
+	}
+	return nil
+}
+
+func newBackupId() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// pinSegments freezes the current segment list and keeps merges from removing
+// its files until unpinSegments is called
+func (db *DB) pinSegments() backupView {
+	db.rw.Lock()
+	defer db.rw.Unlock()
+
+	return db.pinSegmentsLocked()
+}
+
+// pinSegmentsLocked is pinSegments for callers that hold the db lock
+func (db *DB) pinSegmentsLocked() backupView {
+	db.backupPins++
+
+	return backupView{
+		metas:      db.segmentMetas(),
+		activeSize: db.segments[len(db.segments)-1].size,
+	}
+}
+
+// unpinSegments releases a pin, the last one removes the files merges left behind
+func (db *DB) unpinSegments() {
+	db.rw.Lock()
+	defer db.rw.Unlock()
+
+	db.backupPins--
+	if db.backupPins > 0 {
+		return
+	}
+
+	for _, id := range db.pinnedRemovals {
+		db.dropSegmentFile(id)
+	}
+	db.pinnedRemovals = nil
+}
+
+// removeSegmentFile drops the file of a segment that's merged away, or
+// postpones it while backups are running. Caller must hold the db lock.
+func (db *DB) removeSegmentFile(id int) {
+	if db.backupPins > 0 {
+		db.pinnedRemovals = append(db.pinnedRemovals, id)
+		return
+	}
+
+	db.dropSegmentFile(id)
+}
+
+// linkOrCopyFile hard links src to dst, or copies the first size bytes
+// of src if linking isn't possible, e.g. across file systems.
+func linkOrCopyFile(src, dst string, size int64) error {
+	if err := os.Link(src, dst); err != nil {
+		return copyFile(src, dst, 0, size)
+	}
+
+	// inactive segments aren't necessarily synced yet
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	return f.Sync()
+}
+
+// copyFile copies bytes [start, end) of src to a new file at dst and syncs it
+func copyFile(src, dst string, start, end int64) (rerr error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint:errcheck
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := out.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	if _, err := io.Copy(out, io.NewSectionReader(in, start, end-start)); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
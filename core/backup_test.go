@@ -0,0 +1,155 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithRolloverThreshold(100), WithMergeEnabled(false))
+	for i := range 10 {
+		_ = db.Set(fmt.Sprintf("k%d", i), "before")
+	}
+	_ = db.Delete("k0")
+
+	dest := filepath.Join(t.TempDir(), "backup")
+	if _, err := db.Backup(dest); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	segments := len(db.segments)
+
+	// writes after the backup don't show up in it
+	_ = db.Set("k1", "after")
+	_ = db.Set("k10", "after")
+
+	rep, err := Verify(dest)
+	if err != nil || !rep.OK() {
+		t.Fatalf("expected a clean backup, got %+v, %v", rep, err)
+	}
+
+	db2, err := Open(dest, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if st := db2.Stats(); st.Keys != 9 || st.Segments != segments {
+		t.Fatalf("unexpected stats of the backup: %+v", st)
+	}
+	if v, err := db2.Get("k1"); err != nil || v != "before" {
+		t.Fatalf("expected k1=before, got %q, %v", v, err)
+	}
+
+	if _, err := db.Backup(dest); err == nil {
+		t.Fatalf("expected backup into a non-empty directory to fail")
+	}
+}
+
+func TestBackupPinsMergedSegments(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+	for i := range 3 {
+		_ = db.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	inputs := db.segments[:len(db.segments)-1]
+
+	// a backup is running while the merge completes
+	_ = db.pinSegments()
+
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	for _, seg := range inputs {
+		if _, err := os.Stat(getSegmentPath(dir, seg.id)); err != nil {
+			t.Fatalf("expected segment %d to be kept for the backup: %v", seg.id, err)
+		}
+	}
+
+	db.unpinSegments()
+
+	for _, seg := range inputs {
+		if _, err := os.Stat(getSegmentPath(dir, seg.id)); !os.IsNotExist(err) {
+			t.Fatalf("expected segment %d to be removed, got %v", seg.id, err)
+		}
+	}
+	if v, err := db.Get("k2"); err != nil || v != "v" {
+		t.Fatalf("expected k2=v, got %q, %v", v, err)
+	}
+}
+
+func TestBackupIncremental(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithRolloverThreshold(100), WithMergeEnabled(false))
+	tmp := t.TempDir()
+	chain := []string{filepath.Join(tmp, "full"), filepath.Join(tmp, "inc1"), filepath.Join(tmp, "inc2")}
+
+	set := func(from, to int, val string) {
+		for i := from; i < to; i++ {
+			_ = db.Set(fmt.Sprintf("k%02d", i), val)
+		}
+	}
+
+	set(0, 10, "full")
+	token, err := db.Backup(chain[0])
+	if err != nil {
+		t.Fatalf("full backup: %v", err)
+	}
+	fullSegs := len(db.segments)
+
+	// the active segment grows and new segments are created
+	set(5, 15, "inc1")
+	if token, err = db.BackupIncremental(chain[1], token); err != nil {
+		t.Fatalf("first incremental backup: %v", err)
+	}
+	inc1Segs := len(db.segments)
+
+	// merged segments are new segments too
+	set(0, 3, "inc2")
+	_ = db.Delete("k14")
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if _, err = db.BackupIncremental(chain[2], token); err != nil {
+		t.Fatalf("second incremental backup: %v", err)
+	}
+	want, _ := ListSegments(db.dir)
+
+	// only the new segments and the tail of the previously active one are copied
+	if files, _ := listSegmentFiles(chain[1]); len(files) != inc1Segs-fullSegs+1 {
+		t.Fatalf("expected only new segments in the incremental backup, got %v", files)
+	}
+
+	dest := filepath.Join(tmp, "restored")
+	if err := RestoreBackup(dest, chain...); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	rep, err := Verify(dest)
+	if err != nil || !rep.OK() {
+		t.Fatalf("expected a clean restore, got %+v, %v", rep, err)
+	}
+	if got, _ := ListSegments(dest); len(got) != len(want) {
+		t.Fatalf("expected %d segments, got %d", len(want), len(got))
+	}
+
+	db2, err := Open(dest, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open restored: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if st := db2.Stats(); st.Keys != 14 {
+		t.Fatalf("expected 14 keys, got %d", st.Keys)
+	}
+	for key, val := range map[string]string{"k00": "inc2", "k04": "full", "k05": "inc1", "k13": "inc1"} {
+		if v, err := db2.Get(key); err != nil || v != val {
+			t.Fatalf("expected %s=%s, got %q, %v", key, val, v, err)
+		}
+	}
+
+	// a chain with a gap can't be restored
+	if err := RestoreBackup(filepath.Join(tmp, "gap"), chain[0], chain[2]); !errors.Is(err, ErrBackupChain) {
+		t.Fatalf("expected invalid chain, got %v", err)
+	}
+}
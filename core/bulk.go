@@ -0,0 +1,274 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/xxh3"
+)
+
+// entriesTmpName holds the checkpoint index entries while a SegmentWriter
+// runs, it has the tmp suffix so Open removes it if the writer was abandoned
+const entriesTmpName = checkpointName + ".entries" + tmpSuffix
+
+var ErrKeyOrder = errors.New("keys must be strictly increasing")
+
+// SegmentWriter builds a data directory offline from keys in increasing order.
+// Segments are written the way a merge would, without old values or
+// tombstones, so the result needs no merging. Close writes the MANIFEST, and
+// an index checkpoint so that Open with WithCheckpoint skips scanning.
+type SegmentWriter struct {
+	dir       string
+	threshold int64
+
+	seg     *segment // segment being written, nil before the first key
+	metas   []segmentMeta
+	nextId  int
+	keys    uint64
+	lastKey string
+
+	entries  *os.File      // checkpoint index entries, in key order
+	entriesW *bufio.Writer // buffers entries
+	buf      []byte        // encodes an entry
+}
+
+// WriterOption configures a SegmentWriter
+type WriterOption func(*SegmentWriter)
+
+// WithWriterRolloverThreshold sets the record bytes of each segment
+// the writer fills, like WithRolloverThreshold does for a DB
+func WithWriterRolloverThreshold(n int64) WriterOption {
+	return func(w *SegmentWriter) { w.threshold = n }
+}
+
+// NewSegmentWriter starts a data directory in dir, which must not exist or be empty
+func NewSegmentWriter(dir string, opts ...WriterOption) (*SegmentWriter, error) {
+	w := &SegmentWriter{dir: dir, threshold: defaultRolloverThreshold, nextId: 1}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	if err := createEmptyDir(dir); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, entriesTmpName), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create checkpoint entries: %w", err)
+	}
+
+	w.entries, w.entriesW = f, bufio.NewWriter(f)
+	return w, nil
+}
+
+// Add writes key, it must be greater than the previous one
+func (w *SegmentWriter) Add(key, val string) error {
+	if w.keys > 0 && key <= w.lastKey {
+		return fmt.Errorf("%w: %q after %q", ErrKeyOrder, key, w.lastKey)
+	}
+
+	if w.seg == nil || w.seg.dataSize() >= w.threshold {
+		if err := w.rollover(); err != nil {
+			return err
+		}
+	}
+
+	off, err := w.seg.write(key, val, TypeSet, 0, false)
+	if err != nil {
+		return fmt.Errorf("write key %q on segment %d: %w", key, w.seg.id, err)
+	}
+
+	loc := recordLocation{segId: uint32(w.seg.id), valSize: uint32(len(val)), offset: off}
+	w.buf = appendCheckpointEntry(w.buf[:0], key, loc)
+	if _, err := w.entriesW.Write(w.buf); err != nil {
+		return fmt.Errorf("write checkpoint entry: %w", err)
+	}
+
+	w.keys++
+	w.lastKey = key
+	return nil
+}
+
+// rollover seals the current segment and starts a new one
+func (w *SegmentWriter) rollover() error {
+	if err := w.seal(); err != nil {
+		return err
+	}
+
+	seg, err := newSegment(w.dir, w.nextId, segFlagMerged)
+	if err != nil {
+		return err
+	}
+	w.nextId++
+
+	// a merge of the segments written by Set would have the same generation
+	seg.generation = 1
+	w.seg = seg
+	return nil
+}
+
+// seal syncs and closes the current segment
+func (w *SegmentWriter) seal() error {
+	if w.seg == nil {
+		return nil
+	}
+
+	seg := w.seg
+	w.seg = nil
+
+	err := seg.file.Sync()
+	if cerr := seg.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("seal segment %d: %w", seg.id, err)
+	}
+
+	m := segmentMeta{id: seg.id, size: seg.size, records: seg.records, generation: seg.generation, flags: metaSealed | metaMerged}
+	w.metas = append(w.metas, m)
+	return nil
+}
+
+// Close seals the last segment and writes the MANIFEST, which makes the data
+// directory complete. If the writer fails, the directory should be removed.
+func (w *SegmentWriter) Close() (rerr error) {
+	defer func() {
+		rerr = errors.Join(rerr, w.entries.Close(), removeIfExists(filepath.Join(w.dir, entriesTmpName)))
+	}()
+
+	if err := w.seal(); err != nil {
+		return err
+	}
+
+	// an empty active segment to take the writes after Open
+	active, err := newSegment(w.dir, w.nextId, 0)
+	if err != nil {
+		return err
+	}
+	w.metas = append(w.metas, segmentMeta{id: active.id})
+
+	err = active.file.Sync()
+	if cerr := active.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("sync segment %d: %w", active.id, err)
+	}
+
+	if err := w.writeCheckpoint(active.size); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+
+	// the manifest is written last, the directory can't be opened before
+	if err := replaceFileAtomic(filepath.Join(w.dir, manifestName), encodeManifestSnapshot(w.metas)); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// Abort releases the writer without completing the data directory, which
+// can't be opened then and should be removed
+func (w *SegmentWriter) Abort() error {
+	var errs error
+	if w.seg != nil {
+		errs = w.seg.file.Close()
+		w.seg = nil
+	}
+	return errors.Join(errs, w.entries.Close(), removeIfExists(filepath.Join(w.dir, entriesTmpName)))
+}
+
+// writeCheckpoint writes the checkpoint in the format of DB.writeCheckpoint,
+// streaming the index entries from their temp file
+func (w *SegmentWriter) writeCheckpoint(activeSize int64) (rerr error) {
+	if err := w.entriesW.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.entries.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	path := filepath.Join(w.dir, checkpointName)
+	f, err := os.OpenFile(path+tmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	h := xxh3.New()
+	bw := bufio.NewWriter(f)
+	out := io.MultiWriter(bw, h)
+
+	buf := append([]byte(nil), checkpointMagic...)
+	buf = binary.LittleEndian.AppendUint16(buf, checkpointVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(w.metas)))
+	for _, m := range w.metas {
+		size := m.size
+		if !m.sealed() {
+			size = activeSize
+		}
+		buf = binary.AppendUvarint(buf, uint64(m.id))
+		buf = binary.AppendUvarint(buf, uint64(size))
+		buf = binary.AppendUvarint(buf, uint64(m.records))
+	}
+	buf = binary.AppendUvarint(buf, w.keys)
+
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, w.entries); err != nil {
+		return err
+	}
+
+	// no tombstones
+	if _, err := out.Write(binary.AppendUvarint(nil, 0)); err != nil {
+		return err
+	}
+
+	if _, err := bw.Write(binary.LittleEndian.AppendUint64(nil, h.Sum64())); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+tmpSuffix, path)
+}
+
+// BulkLoad builds a data directory in dir from kvs with a SegmentWriter.
+// Keys must be strictly increasing. It's much faster than Set for loading
+// a lot of keys offline, the result is opened with Open.
+func BulkLoad(dir string, kvs iter.Seq2[string, string], opts ...WriterOption) error {
+	w, err := NewSegmentWriter(dir, opts...)
+	if err != nil {
+		return err
+	}
+
+	for key, val := range kvs {
+		if err := w.Add(key, val); err != nil {
+			return errors.Join(err, w.Abort())
+		}
+	}
+
+	return w.Close()
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
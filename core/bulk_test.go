@@ -0,0 +1,76 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBulkLoad(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bulk")
+
+	kvs := func(yield func(string, string) bool) {
+		for i := range 100 {
+			if !yield(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i)) {
+				return
+			}
+		}
+	}
+	if err := BulkLoad(dir, kvs, WithWriterRolloverThreshold(200)); err != nil {
+		t.Fatalf("bulk load: %v", err)
+	}
+
+	// the checkpoint must match the segments
+	rep, err := Verify(dir)
+	if err != nil || !rep.OK() || rep.Keys != 100 || rep.Records != 100 {
+		t.Fatalf("expected a clean directory, got %+v, %v", rep, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, entriesTmpName)); !os.IsNotExist(err) {
+		t.Fatalf("expected checkpoint entries to be removed, got %v", err)
+	}
+
+	for _, checkpoint := range []bool{true, false} {
+		db, err := Open(dir, WithMergeEnabled(false), WithCheckpoint(checkpoint))
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+
+		if st := db.Stats(); st.Keys < 100 || st.Segments < 3 {
+			t.Fatalf("unexpected stats: %+v", st)
+		}
+		for _, seg := range db.segments[:len(db.segments)-1] {
+			if seg.hdr.flags&segFlagMerged == 0 {
+				t.Fatalf("expected segment %d to be written as merged", seg.id)
+			}
+		}
+		if v, err := db.Get("k042"); err != nil || v != "v42" {
+			t.Fatalf("expected k042=v42, got %q, %v", v, err)
+		}
+
+		// writes go to the empty active segment
+		if err := db.Set(fmt.Sprintf("new%v", checkpoint), "v"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		_ = db.Close()
+	}
+
+	// keys out of order leave an incomplete directory
+	dir = filepath.Join(t.TempDir(), "unsorted")
+	w, err := NewSegmentWriter(dir)
+	if err != nil {
+		t.Fatalf("new segment writer: %v", err)
+	}
+	_ = w.Add("b", "1")
+	if err := w.Add("a", "2"); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("expected key order error, got %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); !os.IsNotExist(err) {
+		t.Fatalf("expected no manifest, got %v", err)
+	}
+
+}
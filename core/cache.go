@@ -0,0 +1,74 @@
+package core
+
+import "sync/atomic"
+
+// WithValueCache keeps recently read values in memory, up to
+// about maxBytes including the bookkeeping of each entry.
+func WithValueCache(maxBytes int64) Option {
+	return func(db *DB) { db.valueCache = newValueCache(maxBytes) }
+}
+
+// valueCache caches values by the location of their record. Records are never
+// modified in place and segment ids are never reused, so a cached location
+// can't return a wrong value. Entries are still invalidated when their key
+// moves, so they don't take the space of live values. A nil cache is disabled.
+type valueCache struct {
+	lru    *lru[recordLocation, string]
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newValueCache(maxBytes int64) *valueCache {
+	return &valueCache{lru: newLRU[recordLocation, string](maxBytes)}
+}
+
+func (c *valueCache) get(loc recordLocation) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	val, ok := c.lru.get(loc)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+
+	return val, ok
+}
+
+func (c *valueCache) add(loc recordLocation, val string) {
+	if c == nil {
+		return
+	}
+	c.lru.add(loc, val, int64(len(val))+lruEntryOverhead)
+}
+
+func (c *valueCache) remove(loc recordLocation) {
+	if c == nil {
+		return
+	}
+	c.lru.remove(loc)
+}
+
+// move carries the cached value of a relocated record over to its new location
+func (c *valueCache) move(from, to recordLocation) {
+	if c == nil {
+		return
+	}
+
+	if val, ok := c.lru.get(from); ok {
+		c.lru.remove(from)
+		c.add(to, val)
+	}
+}
+
+// stats returns hits, misses and the bytes held by the cache
+func (c *valueCache) stats() (int64, int64, int64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+
+	_, used := c.lru.stats()
+	return c.hits.Load(), c.misses.Load(), used
+}
@@ -0,0 +1,234 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/zeebo/xxh3"
+)
+
+// The checkpoint is a snapshot of the index written on Close. On Open, it lets
+// us skip scanning the segments: the index is loaded from the checkpoint and only
+// the records appended to the active segment after the checkpoint are replayed.
+//
+// Layout (little endian, varints are unsigned):
+//
+//	[8-byte magic][2-byte version]
+//	[varint segment count] { [varint id][varint size][varint records] } ...  manifest order, last one is active
+//	[varint index count] { [varint keyLen][key][varint segment id][varint offset][varint value size] } ...
+//	[varint tombstone count] { same as index entries } ...
+//	[8-byte checksum of everything before]
+//
+// Records covered by the checkpoint are not verified with their checksums on Open.
+const checkpointName = "CHECKPOINT"
+
+const checkpointVersion = 3
+
+var checkpointMagic = []byte("BITDBCKP")
+
+var errInvalidCheckpoint = errors.New("invalid checkpoint")
+
+// WithCheckpoint makes Close write an index checkpoint which
+// is used by the next Open to avoid scanning all segments.
+func WithCheckpoint(b bool) Option {
+	return func(db *DB) { db.checkpointEnabled = b }
+}
+
+// checkpointSegment is a segment as it was when the checkpoint was taken
+type checkpointSegment struct {
+	id      int
+	size    int64
+	records int64
+}
+
+// writeCheckpoint snapshots the segment list and the index to the checkpoint file.
+// Caller must hold the db lock.
+func (db *DB) writeCheckpoint() error {
+	buf := make([]byte, 0, 64*(db.index.len()+db.tombstones.len()))
+	buf = append(buf, checkpointMagic...)
+	buf = binary.LittleEndian.AppendUint16(buf, checkpointVersion)
+
+	buf = binary.AppendUvarint(buf, uint64(len(db.segments)))
+	for _, seg := range db.segments {
+		buf = binary.AppendUvarint(buf, uint64(seg.id))
+		buf = binary.AppendUvarint(buf, uint64(seg.size))
+		buf = binary.AppendUvarint(buf, uint64(seg.records))
+	}
+
+	buf = appendCheckpointLocations(buf, db.index)
+	buf = appendCheckpointLocations(buf, db.tombstones)
+
+	buf = binary.LittleEndian.AppendUint64(buf, xxh3.Hash(buf))
+
+	return replaceFileAtomic(filepath.Join(db.dir, checkpointName), buf)
+}
+
+func appendCheckpointLocations(buf []byte, kd keydir) []byte {
+	buf = binary.AppendUvarint(buf, uint64(kd.len()))
+	kd.forEach(func(key string, loc recordLocation) bool {
+		buf = appendCheckpointEntry(buf, key, loc)
+		return true
+	})
+	return buf
+}
+
+// appendCheckpointEntry appends an index entry of the checkpoint
+func appendCheckpointEntry(buf []byte, key string, loc recordLocation) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, uint64(loc.segId))
+	buf = binary.AppendUvarint(buf, uint64(loc.offset))
+	return binary.AppendUvarint(buf, uint64(loc.valSize))
+}
+
+// loadCheckpoint tries to restore the segments and the index from the checkpoint.
+// It returns false if there's no usable checkpoint, in which case segments
+// should be loaded by scanning them. A checkpoint is only usable if it's
+// intact and it was taken with the same MANIFEST.
+func (db *DB) loadCheckpoint(segIds []int) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(db.dir, checkpointName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read checkpoint: %w", err)
+	}
+
+	r, segs, err := parseCheckpoint(data)
+	if err == nil {
+		err = validateCheckpoint(db.dir, segs, segIds)
+	}
+	if err != nil {
+		log.Printf("ignoring checkpoint: %v", err)
+		return false, nil
+	}
+
+	// open the segments first, so index entries can point to them.
+	// on any failure from here on, AbortOpen closes them.
+	for i, cs := range segs {
+		seg, err := openSegment(db.dir, cs.id, cs.size)
+		if err != nil {
+			return false, fmt.Errorf("load segment %d: %w", cs.id, err)
+		}
+		seg.records = cs.records
+		db.addSegment(seg)
+
+		if db.onLoadProgress != nil {
+			db.onLoadProgress(i+1, len(segs))
+		}
+	}
+
+	if err := readCheckpointLocations(r, db.segById, db.index); err != nil {
+		return false, fmt.Errorf("decode checkpoint index: %w", err)
+	}
+
+	if err := readCheckpointLocations(r, db.segById, db.tombstones); err != nil {
+		return false, fmt.Errorf("decode checkpoint tombstones: %w", err)
+	}
+
+	// replay the records written to the active segment after the checkpoint
+	active := db.segments[len(db.segments)-1]
+	recs, err := active.scan(db.checksumEnabled, db.skipCorrupted)
+	if err != nil {
+		return false, fmt.Errorf("load segment %d: %w", active.id, err)
+	}
+	db.corruptions = append(db.corruptions, active.lost...)
+
+	db.applyRecords(active, recs)
+
+	return true, nil
+}
+
+// validateCheckpoint checks whether the checkpoint still describes the data directory
+func validateCheckpoint(dir string, segs []checkpointSegment, segIds []int) error {
+	ids := make([]int, len(segs))
+	for i, cs := range segs {
+		ids[i] = cs.id
+	}
+
+	if len(segs) == 0 || !slices.Equal(ids, segIds) {
+		return fmt.Errorf("%w: manifest changed since checkpoint", errInvalidCheckpoint)
+	}
+
+	for i, cs := range segs {
+		info, err := os.Stat(getSegmentPath(dir, cs.id))
+		if err != nil {
+			return fmt.Errorf("%w: stat segment %d: %v", errInvalidCheckpoint, cs.id, err)
+		}
+
+		// inactive segments must be unchanged, active one
+		// may only have grown since the checkpoint
+		isActive := i == len(segs)-1
+		if (!isActive && info.Size() != cs.size) || (isActive && info.Size() < cs.size) {
+			return fmt.Errorf("%w: segment %d size changed from %d to %d",
+				errInvalidCheckpoint, cs.id, cs.size, info.Size())
+		}
+	}
+
+	return nil
+}
+
+// parseCheckpoint verifies the checkpoint and decodes its segment list.
+// Returned reader is positioned at the index entries.
+func parseCheckpoint(data []byte) (*byteReader, []checkpointSegment, error) {
+	const minLen = 8 + 2 + csLen
+	if len(data) < minLen || string(data[:len(checkpointMagic)]) != string(checkpointMagic) {
+		return nil, nil, fmt.Errorf("%w: bad magic", errInvalidCheckpoint)
+	}
+
+	body, sum := data[:len(data)-csLen], binary.LittleEndian.Uint64(data[len(data)-csLen:])
+	if computed := xxh3.Hash(body); computed != sum {
+		return nil, nil, fmt.Errorf("%w: %w: expected %x, got %x",
+			errInvalidCheckpoint, ErrChecksumMismatch, sum, computed)
+	}
+
+	if v := binary.LittleEndian.Uint16(body[len(checkpointMagic):]); v != checkpointVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", errInvalidCheckpoint, v)
+	}
+
+	r := &byteReader{buf: body[len(checkpointMagic)+2:]}
+
+	n := r.uvarint()
+	var segs []checkpointSegment
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		segs = append(segs, checkpointSegment{id: int(r.uvarint()), size: int64(r.uvarint()), records: int64(r.uvarint())})
+	}
+
+	if r.err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidCheckpoint, r.err)
+	}
+
+	return r, segs, nil
+}
+
+// readCheckpointLocations decodes a list of key locations into kd, resolving segments by their ids
+func readCheckpointLocations(r *byteReader, byId map[int]*segment, kd keydir) error {
+	n := r.uvarint()
+
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		key := string(r.bytes(r.uvarint()))
+		id, off, valSize := int(r.uvarint()), int64(r.uvarint()), uint32(r.uvarint())
+		if r.err != nil {
+			break
+		}
+
+		seg, ok := byId[id]
+		if !ok || off >= seg.size {
+			return fmt.Errorf("%w: key %q points to unknown location %d:%d",
+				errInvalidCheckpoint, key, id, off)
+		}
+
+		kd.put(key, recordLocation{segId: uint32(id), valSize: valSize, offset: off})
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("%w: %w", errInvalidCheckpoint, r.err)
+	}
+
+	return nil
+}
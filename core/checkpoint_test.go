@@ -0,0 +1,157 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fillCheckpointDB writes some keys over several segments and deletes a few
+func fillCheckpointDB(t *testing.T, db *DB) {
+	t.Helper()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Set(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%02d", i)); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	for i := 0; i < 20; i += 5 {
+		if err := db.Delete(fmt.Sprintf("k%02d", i)); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+}
+
+func checkCheckpointDB(t *testing.T, db *DB) {
+	t.Helper()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		val, err := db.Get(key)
+		if i%5 == 0 {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected %s to be deleted, got %q, %v", key, val, err)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("v%02d", i); err != nil || val != want {
+			t.Errorf("expected %s=%s, got %q, %v", key, want, val, err)
+		}
+	}
+}
+
+func TestCheckpointRestart(t *testing.T) {
+	opts := []Option{WithRolloverThreshold(100), WithMergeEnabled(false), WithCheckpoint(true)}
+	db, dir, _ := SetupTempDB(t, opts...)
+
+	fillCheckpointDB(t, db)
+	_ = db.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, checkpointName)); err != nil {
+		t.Fatalf("checkpoint not written: %v", err)
+	}
+
+	// corrupt a value in the first (inactive) segment. a full scan would
+	// fail on it, but the checkpoint lets Open skip scanning that segment.
+	f, _ := os.OpenFile(getSegmentPath(dir, 1), os.O_WRONLY, 0o644)
+	_, _ = f.WriteAt([]byte("X"), segHdrLen+hdrLen+3) // 3 = len("k00")
+	_ = f.Close()
+
+	if _, err := Open(dir, WithMergeEnabled(false)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected full scan to fail with checksum mismatch, got %v", err)
+	}
+
+	db2, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("reopen with checkpoint: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if got, want := db2.tombstones.len(), 4; got != want {
+		t.Errorf("expected %d tombstones from checkpoint, got %d", want, got)
+	}
+
+	checkCheckpointDB(t, db2)
+}
+
+// TestCheckpointReplaysActiveTail writes to the active segment after the
+// checkpoint and reopens without Close, like after a crash.
+func TestCheckpointReplaysActiveTail(t *testing.T) {
+	opts := []Option{WithMergeEnabled(false), WithCheckpoint(true)}
+	db, dir, _ := SetupTempDB(t, opts...)
+
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "1")
+	_ = db.Close()
+
+	db2, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+
+	// these are after the checkpoint offset. db2 is never closed
+	_ = db2.Set("a", "2")
+	_ = db2.Delete("b")
+	_ = db2.Set("c", "2")
+
+	db3, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("reopen after crash: %v", err)
+	}
+	defer db3.Close() // nolint:errcheck
+
+	if v, err := db3.Get("a"); err != nil || v != "2" {
+		t.Errorf("expected a=2, got %q, %v", v, err)
+	}
+	if _, err := db3.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected b to be deleted, got %v", err)
+	}
+	if v, err := db3.Get("c"); err != nil || v != "2" {
+		t.Errorf("expected c=2, got %q, %v", v, err)
+	}
+}
+
+// TestCheckpointIgnoredWhenStale changes the MANIFEST after the checkpoint
+// and corrupts another checkpoint, both must fall back to scanning.
+func TestCheckpointIgnoredWhenStale(t *testing.T) {
+	opts := []Option{WithRolloverThreshold(100), WithMergeEnabled(false), WithCheckpoint(true)}
+	db, dir, _ := SetupTempDB(t, opts...)
+
+	_ = db.Set("old", "1")
+	_ = db.Close()
+
+	// open without checkpoint, rollover so that manifest changes,
+	// and close without writing a new checkpoint
+	db2, err := Open(dir, WithRolloverThreshold(100), WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	fillCheckpointDB(t, db2)
+	_ = db2.Close()
+
+	db3, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("reopen with stale checkpoint: %v", err)
+	}
+	checkCheckpointDB(t, db3)
+	if v, err := db3.Get("old"); err != nil || v != "1" {
+		t.Errorf("expected old=1, got %q, %v", v, err)
+	}
+	_ = db3.Close()
+
+	// flip a byte in the checkpoint body
+	path := filepath.Join(dir, checkpointName)
+	data, _ := os.ReadFile(path)
+	data[len(checkpointMagic)+3] ^= 0xff
+	_ = os.WriteFile(path, data, 0o644)
+
+	db4, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("reopen with corrupted checkpoint: %v", err)
+	}
+	defer db4.Close() // nolint:errcheck
+
+	checkCheckpointDB(t, db4)
+}
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/deckarep/golang-set/v2"
+)
+
+// OrphanPolicy decides what Open does with segment files
+// that exist in the data directory but aren't in the MANIFEST.
+type OrphanPolicy int
+
+const (
+	// OrphanKeep leaves orphaned segments in place and logs a warning
+	OrphanKeep OrphanPolicy = iota
+	// OrphanQuarantine moves orphaned segments to the orphans directory
+	OrphanQuarantine
+	// OrphanDelete removes orphaned segments
+	OrphanDelete
+)
+
+const orphansDirName = "orphans"
+
+const tmpSuffix = ".tmp"
+
+// tempTargets are the files written through a temp file, relative to the data
+// directory. Other temp files aren't ours, Open leaves them alone.
+var tempTargets = []string{
+	manifestName,
+	checkpointName,
+	strings.TrimSuffix(entriesTmpName, tmpSuffix),
+	filepath.Join(archiveDirName, historyName),
+}
+
+// WithOrphanPolicy sets what Open does with orphaned segments. They are left
+// behind by a crash during a merge, or when removing merged segments fails.
+func WithOrphanPolicy(p OrphanPolicy) Option {
+	return func(db *DB) { db.orphanPolicy = p }
+}
+
+// OpenReport lists the files Open cleaned up in the data directory
+type OpenReport struct {
+	RemovedTempFiles    []string // leftovers of interrupted atomic writes
+	RecoveredFiles      []string // temp files that were put in place of their missing target
+	OrphanedSegments    []string // segment files missing from the MANIFEST
+	QuarantinedSegments []string // orphaned segments moved to the orphans directory
+	DeletedSegments     []string // orphaned segments removed
+}
+
+// OpenReport returns what Open cleaned up in the data directory
+func (db *DB) OpenReport() OpenReport {
+	return db.openReport
+}
+
+// cleanupTempFiles handles the temp files of atomic writes that didn't complete.
+// The rename is the last step of those writes, so the target still has its old
+// contents and the temp file can be removed. The only exception is a MANIFEST
+// that's missing next to a valid temp file, then the temp file is put in place.
+func (db *DB) cleanupTempFiles() error {
+	// the archive has a file written atomically too, the HISTORY
+	for _, sub := range []string{"", archiveDirName} {
+		entries, err := os.ReadDir(filepath.Join(db.dir, sub))
+		if sub != "" && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read dir: %w", err)
+		}
+
+		for _, entry := range entries {
+			name := filepath.Join(sub, entry.Name())
+			target, ok := strings.CutSuffix(name, tmpSuffix)
+			if entry.IsDir() || !ok || !slices.Contains(tempTargets, target) {
+				continue
+			}
+
+			path := filepath.Join(db.dir, name)
+
+			if target == manifestName && db.recoverManifest(path) {
+				log.Printf("recovered %s from %s", target, name)
+				db.openReport.RecoveredFiles = append(db.openReport.RecoveredFiles, name)
+				continue
+			}
+
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("remove temp file %q: %w", name, err)
+			}
+
+			log.Printf("removed stale temp file %s", name)
+			db.openReport.RemovedTempFiles = append(db.openReport.RemovedTempFiles, name)
+		}
+	}
+
+	return nil
+}
+
+// recoverManifest renames the temp manifest at path in place of
+// a missing MANIFEST. It reports whether the recovery happened.
+func (db *DB) recoverManifest(path string) bool {
+	target := filepath.Join(db.dir, manifestName)
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		return false
+	}
+
+	// only a complete manifest in the current format can be trusted
+	st, err := readManifest(path)
+	if err != nil || st.legacy {
+		return false
+	}
+
+	if err := os.Rename(path, target); err != nil {
+		log.Printf("recover manifest: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// migrateSegmentNames renames segment files of the old naming scheme.
+// Renames are idempotent, so a crash halfway is fixed by the next Open.
+func (db *DB) migrateSegmentNames() error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return fmt.Errorf("read dir: %w", err)
+	}
+
+	renamed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		id, legacy, ok := parseSegmentName(name)
+		if entry.IsDir() || !ok || !legacy {
+			continue
+		}
+
+		newPath := getSegmentPath(db.dir, id)
+		if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+			return fmt.Errorf("rename segment %s: %s already exists", name, filepath.Base(newPath))
+		}
+
+		if err := os.Rename(filepath.Join(db.dir, name), newPath); err != nil {
+			return fmt.Errorf("rename segment %s: %w", name, err)
+		}
+		renamed++
+	}
+
+	if renamed == 0 {
+		return nil
+	}
+
+	log.Printf("renamed %d segments to the new naming scheme", renamed)
+
+	// make the renames durable
+	d, err := os.Open(db.dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close() // nolint:errcheck
+
+	return d.Sync()
+}
+
+// We check orphaned segments in case a power loss occurred during a merge operation
+func (db *DB) checkOrphanedSegments(segIds []int) error {
+	// scan directory for segment files
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return fmt.Errorf("read dir: %w", err)
+	}
+
+	// segment files in the manifest
+	expected := mapset.NewSet[string]()
+	for _, id := range segIds {
+		expected.Add(segmentFileName(id))
+	}
+
+	// actual segment files
+	actual := mapset.NewSet[string]()
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, _, ok := parseSegmentName(name); entry.IsDir() || !ok {
+			continue
+		}
+
+		actual.Add(name)
+	}
+
+	orphans := actual.Difference(expected).ToSlice()
+	if len(orphans) == 0 {
+		return nil
+	}
+	slices.Sort(orphans)
+
+	db.openReport.OrphanedSegments = orphans
+
+	switch db.orphanPolicy {
+	case OrphanQuarantine:
+		qdir := filepath.Join(db.dir, orphansDirName)
+		if err := os.MkdirAll(qdir, 0o755); err != nil {
+			return fmt.Errorf("mkdir %q: %w", qdir, err)
+		}
+
+		for _, name := range orphans {
+			if err := os.Rename(filepath.Join(db.dir, name), filepath.Join(qdir, name)); err != nil {
+				return fmt.Errorf("quarantine segment %s: %w", name, err)
+			}
+			db.openReport.QuarantinedSegments = append(db.openReport.QuarantinedSegments, name)
+		}
+
+		log.Printf("quarantined orphaned segments to %s: %v", qdir, orphans)
+	case OrphanDelete:
+		for _, name := range orphans {
+			if err := os.Remove(filepath.Join(db.dir, name)); err != nil {
+				return fmt.Errorf("delete segment %s: %w", name, err)
+			}
+			db.openReport.DeletedSegments = append(db.openReport.DeletedSegments, name)
+		}
+
+		log.Printf("deleted orphaned segments: %v", orphans)
+	default:
+		log.Printf("warning: orphaned segments exist: %v", orphans)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// setupOrphans creates a db with one segment and leaves an orphaned
+// segment and a stale MANIFEST.tmp behind, next to a temp file that isn't ours
+func setupOrphans(t *testing.T) string {
+	t.Helper()
+
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Close()
+
+	_ = os.WriteFile(getSegmentPath(dir, 7), []byte("left by a merge"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, manifestName+tmpSuffix), []byte("partial"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "notes"+tmpSuffix), []byte("someone else's"), 0o644)
+
+	return dir
+}
+
+func TestOpenCleansUpOrphans(t *testing.T) {
+	orphan := filepath.Base(getSegmentPath("", 7))
+
+	for _, tc := range []struct {
+		name   string
+		policy OrphanPolicy
+		check  func(t *testing.T, dir string, rep OpenReport)
+	}{
+		{"keep", OrphanKeep, func(t *testing.T, dir string, rep OpenReport) {
+			if _, err := os.Stat(filepath.Join(dir, orphan)); err != nil {
+				t.Fatalf("expected orphan to be kept: %v", err)
+			}
+		}},
+		{"quarantine", OrphanQuarantine, func(t *testing.T, dir string, rep OpenReport) {
+			if _, err := os.Stat(filepath.Join(dir, orphansDirName, orphan)); err != nil {
+				t.Fatalf("expected orphan to be quarantined: %v", err)
+			}
+			if !slices.Equal(rep.QuarantinedSegments, []string{orphan}) {
+				t.Fatalf("unexpected report: %+v", rep)
+			}
+		}},
+		{"delete", OrphanDelete, func(t *testing.T, dir string, rep OpenReport) {
+			if _, err := os.Stat(filepath.Join(dir, orphan)); !os.IsNotExist(err) {
+				t.Fatalf("expected orphan to be deleted, got %v", err)
+			}
+			if !slices.Equal(rep.DeletedSegments, []string{orphan}) {
+				t.Fatalf("unexpected report: %+v", rep)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := setupOrphans(t)
+
+			db, err := Open(dir, WithMergeEnabled(false), WithOrphanPolicy(tc.policy))
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer db.Close() // nolint:errcheck
+
+			rep := db.OpenReport()
+			if !slices.Equal(rep.OrphanedSegments, []string{orphan}) {
+				t.Fatalf("expected orphan %s in report, got %+v", orphan, rep)
+			}
+			if !slices.Equal(rep.RemovedTempFiles, []string{manifestName + tmpSuffix}) {
+				t.Fatalf("expected stale manifest temp file in report, got %+v", rep)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "notes"+tmpSuffix)); err != nil {
+				t.Fatalf("expected unknown temp file to be kept: %v", err)
+			}
+			tc.check(t, dir, rep)
+
+			// the manifest can be rewritten again
+			if err := db.compactManifest(); err != nil {
+				t.Fatalf("compact manifest: %v", err)
+			}
+			if v, err := db.Get("a"); err != nil || v != "1" {
+				t.Fatalf("expected a=1, got %q, %v", v, err)
+			}
+		})
+	}
+}
+
+// TestOpenRecoversManifest simulates a crash after the old manifest was
+// removed but before the new one was renamed in place.
+func TestOpenRecoversManifest(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Close()
+
+	path := filepath.Join(dir, manifestName)
+	_ = os.Rename(path, path+tmpSuffix)
+
+	db2, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if rep := db2.OpenReport(); !slices.Equal(rep.RecoveredFiles, []string{manifestName + tmpSuffix}) {
+		t.Fatalf("expected manifest recovery in report, got %+v", rep)
+	}
+	if v, err := db2.Get("a"); err != nil || v != "1" {
+		t.Fatalf("expected a=1, got %q, %v", v, err)
+	}
+}
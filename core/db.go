@@ -2,40 +2,74 @@
 package core
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-
-	"github.com/deckarep/golang-set/v2"
+	"time"
 )
 
 // todo merge configuration under one struct
 
 type DB struct {
-	dir               string                     // data directory
-	segments          []*segment                 // all segments. last one is the active segment
-	fsync             bool                       // whether to fsync on each Set call
-	mergeSem          chan struct{}              // merge semaphore
-	rw                sync.RWMutex               // guards segments & index & manifest
-	mergeErr          chan error                 // async merge error reporting
-	idCtr             int64                      // segment id counter
-	index             map[string]*recordLocation // maps each key to its last-seen location
-	manifest          *os.File                   // open file handle for manifest
-	mergeEnabled      bool                       // whether merge is enabled
-	rolloverThreshold int64                      // rollover segment when the active segment reaches this
-	mergeThreshold    int                        // run merge when inactive(merge-able) segment count reaches this
-	checksumEnabled   bool                       // enable corruption checks on Open and Get
-	onMergeStart      func()                     // test hook
-	onMergeApply      func()                     // test hook
+	dir               string                  // data directory
+	segments          []*segment              // all segments. last one is the active segment
+	fsync             bool                    // whether to fsync on each Set call
+	mergeSem          chan struct{}           // merge semaphore
+	rw                sync.RWMutex            // guards segments & index & manifest
+	mergeErr          chan error              // async merge error reporting
+	idCtr             int64                   // segment id counter
+	segById           map[int]*segment        // segments by id, resolves index locations
+	index             keydir                  // maps each key to its last-seen location
+	tombstones        keydir                  // maps each deleted key to its last tombstone
+	manifest          *os.File                // open file handle for manifest
+	manifestEdits     int                     // number of edits in the manifest log
+	mergeEnabled      bool                    // whether merge is enabled
+	rolloverThreshold int64                   // rollover segment when its records (excluding the header) reach this
+	mergeThreshold    int                     // run merge when inactive(merge-able) segment count reaches this
+	mergeMaxSegments  int                     // merge at most this many of the newest inactive segments, 0 means all
+	checksumEnabled   bool                    // enable corruption checks on Open and Get
+	loadWorkers       int                     // number of segments scanned in parallel on Open
+	onLoadProgress    func(loaded, total int) // reports segment loading progress on Open
+	checkpointEnabled bool                    // write an index checkpoint on Close, use it on Open
+	skipCorrupted     bool                    // skip corrupted regions of segments on Open instead of failing
+	corruptions       []Corruption            // corrupted regions skipped on Open
+	diskIndex         bool                    // keep the index in mmapped files instead of memory
+	indexCacheBytes   int64                   // memory budget of the disk index cache
+	mmapReads         bool                    // serve reads of inactive segments from memory mappings
+	valueCache        *valueCache             // recently read values, nil if disabled
+	orphanPolicy      OrphanPolicy            // what to do with segments missing from the manifest on Open
+	openReport        OpenReport              // files cleaned up by Open
+	backupPins        int                     // running backups, merges keep the files of their inputs meanwhile
+	pinnedRemovals    []int                   // ids of merged segments whose files are removed once backups finish
+	retention         time.Duration           // how long merged segments are kept in the archive, 0 removes them
+	history           *history                // merges in the retention window, nil without retention
+	timestamps        bool                    // store the write time in each record
+	keepVersions      int                     // versions of each key merge keeps, 0 or 1 keeps only the latest
+	keepVersionsFor   time.Duration           // merge keeps versions younger than this too
+	watchers          []*Watcher              // running watches, writes queue events for them
+	watchBuffer       int                     // events a watcher queues before it overflows
+	scrubInterval     time.Duration           // time between background scrub passes, 0 disables the scrubber
+	scrubRate         int64                   // bytes per second read by the background scrubber
+	scrubMarkKeys     bool                    // mark keys whose latest record is corrupted
+	onCorruption      func(Corruption)        // reports corruptions found by the scrubber
+	corruptKeys       map[string]Corruption   // keys marked by the scrubber
+	scrubStats        scrubStats              // scrubber counters
+	scrubStop         chan struct{}           // closed to stop the scrubber
+	scrubStopOnce     sync.Once               // guards closing scrubStop
+	scrubDone         chan struct{}           // closed when the scrubber exits
+	onMergeStart      func()                  // test hook
+	onMergeApply      func()                  // test hook
+
+	// test hook, writes the manifest appends
+	manifestWrite func(f *os.File, b []byte) (int, error)
 }
 
 var ErrKeyNotFound = errors.New("key not found")
@@ -59,6 +93,15 @@ func WithMergeThreshold(n int) Option {
 	}
 }
 
+// WithMergeMaxSegments limits a merge to the n most recent inactive segments.
+// Older segments are left untouched, so tombstones in the merged range are
+// carried over to the output. 0 (the default) merges all inactive segments.
+func WithMergeMaxSegments(n int) Option {
+	return func(db *DB) {
+		db.mergeMaxSegments = n
+	}
+}
+
 func WithOnMergeStart(f func()) Option {
 	return func(db *DB) {
 		db.onMergeStart = f
@@ -71,28 +114,41 @@ func WithOnMergeApply(f func()) Option {
 	}
 }
 
+// WithMmapReads maps inactive segments into memory, so Get doesn't need
+// syscalls for them. The active segment is still read from its file.
+func WithMmapReads(b bool) Option {
+	return func(db *DB) { db.mmapReads = b }
+}
+
 func WithChecksumEnabled(b bool) Option {
 	return func(db *DB) { db.checksumEnabled = b }
 }
 
 type Option func(*DB)
 
+const defaultRolloverThreshold = 1 * 1024 * 1024
+
 func Open(dir string, opts ...Option) (rdb *DB, rerr error) {
 	db := &DB{
 		dir:      dir,
 		mergeSem: make(chan struct{}, 1),
-		index:    make(map[string]*recordLocation),
+		segById:  make(map[int]*segment),
 		// todo mergeErr may not be listened, which will hang the merge goroutine
 		//  should i enforce the listen somehow, or drop errors?
-		mergeErr:     make(chan error, 1),
-		onMergeStart: func() {},
-		onMergeApply: func() {},
+		mergeErr:      make(chan error, 1),
+		onMergeStart:  func() {},
+		onMergeApply:  func() {},
+		manifestWrite: (*os.File).Write,
 		// default values
 		fsync:             false,
-		rolloverThreshold: 1 * 1024 * 1024,
+		rolloverThreshold: defaultRolloverThreshold,
 		mergeEnabled:      true,
 		mergeThreshold:    100,
+		watchBuffer:       defaultWatchBuffer,
 		checksumEnabled:   true,
+		loadWorkers:       runtime.GOMAXPROCS(0),
+		scrubRate:         defaultScrubRate,
+		corruptKeys:       make(map[string]Corruption),
 	}
 
 	// apply options
@@ -113,51 +169,69 @@ func Open(dir string, opts ...Option) (rdb *DB, rerr error) {
 		return nil, fmt.Errorf("mkdir %q: %w", dir, err)
 	}
 
-	mnf, err := ensureManifest(db.dir)
-	if err != nil {
-		return nil, fmt.Errorf("ensure manifest: %w", err)
+	if err := db.cleanupTempFiles(); err != nil {
+		return nil, fmt.Errorf("cleanup temp files: %w", err)
 	}
-	db.manifest = mnf
 
-	// we will load the segments ordered by the manifest file
-	mnfBytes, err := io.ReadAll(db.manifest)
+	if err := db.migrateSegmentNames(); err != nil {
+		return nil, fmt.Errorf("migrate segment names: %w", err)
+	}
+
+	if db.diskIndex {
+		if err := resetKeydirDir(dir); err != nil {
+			return nil, fmt.Errorf("reset disk index: %w", err)
+		}
+	}
+
+	mnf, mnfState, err := openManifest(db.dir)
 	if err != nil {
-		return nil, fmt.Errorf("read manifest: %w", err)
+		return nil, fmt.Errorf("open manifest: %w", err)
 	}
+	db.manifest, db.manifestEdits = mnf, mnfState.edits
 
-	// parse the manifest and get segment ids
-	mnfIds := strings.Fields(string(mnfBytes))
-	var segIds []int
-	for _, idStr := range mnfIds {
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			// this error is unexpected unless manifest file gets corrupted
-			return nil, fmt.Errorf("read manifest: %w", err)
+	if db.index, err = db.newKeydir("index"); err != nil {
+		return nil, fmt.Errorf("create index: %w", err)
+	}
+	if db.tombstones, err = db.newKeydir("tombstones"); err != nil {
+		return nil, fmt.Errorf("create tombstone index: %w", err)
+	}
+
+	// we will load the segments ordered by the manifest file
+	segIds := mnfState.ids()
+
+	// use the checkpoint if there's a valid one, it saves us scanning the segments
+	loaded := false
+	if db.checkpointEnabled && len(segIds) > 0 {
+		if loaded, err = db.loadCheckpoint(segIds); err != nil {
+			return nil, err
 		}
-		segIds = append(segIds, id)
 	}
 
 	// load all segments according to parsed manifest
-	for _, id := range segIds {
-		seg, recs, err := parseSegment(db.dir, id, db.checksumEnabled)
-		if err != nil {
-			return nil, fmt.Errorf("load segment %q: %w", id, err)
+	if !loaded {
+		if err := db.loadSegments(segIds); err != nil {
+			return nil, err
 		}
+	}
 
-		// update db index with the returned records
-		// We simulate the history. Sets update the index, deletes remove from the index.
-		for _, rec := range recs {
-			switch rec.wt {
-			case TypeDelete:
-				delete(db.index, rec.key)
-			case TypeSet:
-				db.index[rec.key] = &recordLocation{seg: seg, offset: rec.off}
-			default:
-				log.Panicf("unhandled write type: %v", rec.wt)
-			}
+	if err := db.indexErr(); err != nil {
+		return nil, fmt.Errorf("build index: %w", err)
+	}
+
+	db.applySegmentMetas(mnfState.segs)
+
+	// manifests in the old format, or new ones, are rewritten as a snapshot
+	if mnfState.legacy {
+		if err := db.compactManifest(); err != nil {
+			return nil, fmt.Errorf("rewrite manifest: %w", err)
 		}
+	}
 
-		db.segments = append(db.segments, seg)
+	// segments other than the active one are immutable, they can be mapped
+	if db.mmapReads && len(db.segments) > 0 {
+		for _, seg := range db.segments[:len(db.segments)-1] {
+			seg.mapForReads()
+		}
 	}
 
 	// set the segment id counter
@@ -171,6 +245,12 @@ func Open(dir string, opts ...Option) (rdb *DB, rerr error) {
 		return nil, fmt.Errorf("cleanup orphaned segments: %w", err)
 	}
 
+	if db.retention > 0 {
+		if err := db.loadHistory(); err != nil {
+			return nil, fmt.Errorf("load retention history: %w", err)
+		}
+	}
+
 	// in case this is a new folder, we create the empty segment
 	if len(db.segments) == 0 {
 		if err = db.rolloverSegment(); err != nil {
@@ -178,54 +258,62 @@ func Open(dir string, opts ...Option) (rdb *DB, rerr error) {
 		}
 	}
 
+	if db.scrubInterval > 0 {
+		db.startScrubber()
+	}
+
 	return db, nil
 }
 
-func ensureManifest(dir string) (*os.File, error) {
-	manifestPath := filepath.Join(dir, "MANIFEST")
+// Segment files are named after their ids, zero padded to a fixed width so
+// they sort by id: 0000000001.seg, 0000000002.seg, ... Older versions used
+// seg001, seg002, ..., those are renamed on Open.
+const segmentExt = ".seg"
 
-	_, err := os.Stat(manifestPath)
-	if err != nil && !os.IsNotExist(err) {
-		// Some other error trying to Stat
-		return nil, fmt.Errorf("stat manifest: %w", err)
-	}
+const segmentIdWidth = 10
 
-	if os.IsNotExist(err) {
-		// No manifest, let's create it
-		mnf, err := createFileDurable(dir, "MANIFEST")
-		if err != nil {
-			return nil, fmt.Errorf("create manifest: %q", err)
-		}
+const legacySegmentPrefix = "seg"
 
-		return mnf, nil
-	} else {
-		// manifest already exists, return it
-		mnf, err := os.OpenFile(manifestPath, os.O_RDWR, 0o644)
-		if err != nil {
-			return nil, fmt.Errorf("open manifest: %w", err)
+func getSegmentPath(dir string, id int) string {
+	return filepath.Join(dir, segmentFileName(id))
+}
+
+func segmentFileName(id int) string {
+	return fmt.Sprintf("%0*d%s", segmentIdWidth, id, segmentExt)
+}
+
+// parseSegmentName returns the id of a segment file name. legacy is true
+// for the old naming scheme. ok is false for files that aren't segments.
+func parseSegmentName(name string) (id int, legacy bool, ok bool) {
+	digits, isNew := strings.CutSuffix(name, segmentExt)
+	if !isNew {
+		var isLegacy bool
+		if digits, isLegacy = strings.CutPrefix(name, legacySegmentPrefix); !isLegacy {
+			return 0, false, false
 		}
-		return mnf, nil
 	}
-}
 
-func (db *DB) overwriteManifest() error {
-	var buf bytes.Buffer
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, false, false
+	}
 
-	for _, seg := range db.segments {
-		fmt.Fprintf(&buf, "%d\n", seg.id)
+	// new names are only the ones segmentFileName writes
+	if isNew && len(digits) != segmentIdWidth {
+		return 0, false, false
 	}
 
-	if newf, err := writeFileAtomic(db.manifest, buf.Bytes()); err != nil {
-		return fmt.Errorf("atomic write: %w", err)
-	} else {
-		db.manifest = newf
+	id, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, false, false
 	}
 
-	return nil
+	return id, !isNew, true
 }
 
-func getSegmentPath(dir string, id int) string {
-	return filepath.Join(dir, fmt.Sprintf("seg%03d", id))
+// addSegment appends seg to the segment list. Caller must hold the db lock.
+func (db *DB) addSegment(seg *segment) {
+	db.segments = append(db.segments, seg)
+	db.segById[seg.id] = seg
 }
 
 func (db *DB) claimNextSegmentId() int {
@@ -235,35 +323,82 @@ func (db *DB) claimNextSegmentId() int {
 }
 
 // creates an empty segment and appends it to the segment list.
-// triggers a manifest overwrite to make the change persistent.
+// the previous active segment gets sealed in the manifest.
 func (db *DB) rolloverSegment() error {
-	seg, err := newSegment(db.dir, db.claimNextSegmentId())
+	seg, err := newSegment(db.dir, db.claimNextSegmentId(), 0)
 	if err != nil {
 		return fmt.Errorf("create new segment: %w", err)
 	}
 
-	db.segments = append(db.segments, seg)
+	var edits [][]byte
+
+	// the active segment is about to become inactive
+	var prev *segment
+	if len(db.segments) > 0 {
+		prev = db.segments[len(db.segments)-1]
+		edits = append(edits, sealEdit(prev))
+	}
+
+	db.addSegment(seg)
+
+	edits = append(edits, addEdit(db.segmentMeta(seg, false)))
+	if err := db.appendManifest(edits...); err != nil {
+		// the manifest doesn't know the new segment, writes stay on the previous one
+		db.segments = db.segments[:len(db.segments)-1]
+		delete(db.segById, seg.id)
+		return errors.Join(fmt.Errorf("log manifest: %w", err), seg.close(), os.Remove(getSegmentPath(db.dir, seg.id)))
+	}
 
-	if err := db.overwriteManifest(); err != nil {
-		return fmt.Errorf("overwrite manifest: %w", err)
+	if prev != nil && db.mmapReads {
+		prev.mapForReads()
+	}
+
+	if err := db.maybeCompactManifest(); err != nil {
+		return fmt.Errorf("compact manifest: %w", err)
 	}
 
 	return nil
 }
 
+// syncSegments fsyncs every segment, caller must hold the db lock
+func (db *DB) syncSegments() (errs error) {
+	for _, s := range db.segments {
+		if err := s.file.Sync(); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("sync segment %d: %w", s.id, err))
+		}
+	}
+	return errs
+}
+
 func (db *DB) Close() (errs error) {
+	// the scrubber takes the lock, it's stopped before
+	db.stopScrubber()
+
 	db.rw.Lock()
 	defer db.rw.Unlock()
 
-	// close all segments
-	for _, s := range db.segments {
-		// block until the OS has flushed those pages to stable storage
-		if err := s.file.Sync(); err != nil {
-			errs = errors.Join(errs, fmt.Errorf("sync segment %d: %w", s.id, err))
+	db.closeWatchers()
+
+	// block until the OS has flushed those pages to stable storage
+	errs = db.syncSegments()
+
+	// checkpoint is only valid if the records it points to are durable,
+	// so it's written after the segments are synced. the regions skipped on
+	// Open aren't in the checkpoint, so the segments are scanned again instead
+	if db.checkpointEnabled && errs == nil && len(db.corruptions) == 0 {
+		if err := db.writeCheckpoint(); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("write checkpoint: %w", err))
+		}
+	} else if db.checkpointEnabled && len(db.corruptions) > 0 {
+		// an older checkpoint doesn't know about them either
+		if err := removeIfExists(filepath.Join(db.dir, checkpointName)); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("remove checkpoint: %w", err))
 		}
+	}
 
-		// close the file
-		if err := s.file.Close(); err != nil {
+	// close all segments
+	for _, s := range db.segments {
+		if err := s.close(); err != nil {
 			errs = errors.Join(errs, fmt.Errorf("close segment %d: %w", s.id, err))
 		}
 	}
@@ -273,6 +408,30 @@ func (db *DB) Close() (errs error) {
 		errs = errors.Join(errs, fmt.Errorf("close manifest: %w", err))
 	}
 
+	errs = errors.Join(errs, db.closeKeydirs())
+
+	return errs
+}
+
+// indexErr returns the error that made the index or the tombstones unusable
+func (db *DB) indexErr() error {
+	return errors.Join(db.index.err(), db.tombstones.err())
+}
+
+// closeKeydirs releases the index and the tombstones if they were created
+func (db *DB) closeKeydirs() (errs error) {
+	if db.index != nil {
+		if err := db.index.close(); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("close index: %w", err))
+		}
+	}
+
+	if db.tombstones != nil {
+		if err := db.tombstones.close(); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("close tombstone index: %w", err))
+		}
+	}
+
 	return errs
 }
 
@@ -284,7 +443,7 @@ func (db *DB) AbortOpen() (errs error) {
 
 	// close all segments which are opened so far
 	for _, s := range db.segments {
-		if err := s.file.Close(); err != nil {
+		if err := s.close(); err != nil {
 			errs = errors.Join(errs, fmt.Errorf("close segment %d: %w", s.id, err))
 		}
 	}
@@ -296,25 +455,39 @@ func (db *DB) AbortOpen() (errs error) {
 		}
 	}
 
-	return errs
-}
+	errs = errors.Join(errs, db.closeKeydirs())
 
-// recordLocation keeps the address of a record in the multi-segment data layout
-type recordLocation struct {
-	seg    *segment
-	offset int64
+	return errs
 }
 
 func (db *DB) Get(key string) (string, error) {
 	db.rw.RLock()
 	defer db.rw.RUnlock()
 
-	loc, ok := db.index[key]
+	loc, ok := db.index.get(key)
+	if err := db.index.err(); err != nil {
+		return "", fmt.Errorf("look up key %q: %w", key, err)
+	}
 	if !ok {
 		return "", fmt.Errorf("%w: %q", ErrKeyNotFound, key)
 	}
 
-	val, wt, err := loc.seg.read(loc.offset, db.checksumEnabled)
+	seg, ok := db.segById[int(loc.segId)]
+	if !ok {
+		// the segment is gone while the key still points to it. same as
+		// reading from a closed segment file, this implies a lost record
+		return "", fmt.Errorf("segment %d of key %q: %w", loc.segId, key, os.ErrClosed)
+	}
+
+	if c, ok := db.corruptKeys[key]; ok {
+		return "", fmt.Errorf("%w: %q in segment %d at %d: %w", ErrKeyCorrupted, key, c.Segment, c.Offset, c.Err)
+	}
+
+	if val, ok := db.valueCache.get(loc); ok {
+		return val, nil
+	}
+
+	val, wt, err := seg.read(loc.offset, db.checksumEnabled)
 	if err != nil {
 		// this is an unexpected error, because in normal operation,
 		// if key is on index, its corresponding value should exist on the disk file
@@ -335,11 +508,13 @@ func (db *DB) Get(key string) (string, error) {
 		return "", fmt.Errorf("%w: %q", ErrKeyNotFound, key)
 	}
 
+	db.valueCache.add(loc, val)
+
 	return val, nil
 }
 
 func (db *DB) checkRolloverAndMerge(seg *segment) error {
-	if seg.size < db.rolloverThreshold {
+	if seg.dataSize() < db.rolloverThreshold {
 		return nil
 	}
 
@@ -360,19 +535,37 @@ func (db *DB) Set(key, val string) error {
 	db.rw.Lock()
 	defer db.rw.Unlock()
 
+	return db.set(key, val, db.fsync)
+}
+
+// set writes key to the active segment, caller must hold the db lock
+func (db *DB) set(key, val string, fsync bool) error {
 	// get active segment
 	seg := db.segments[len(db.segments)-1]
 
-	off, err := seg.write(key, val, TypeSet, db.fsync)
+	off, err := seg.write(key, val, TypeSet, db.writeTime(), fsync)
 	if err != nil {
 		return fmt.Errorf("write key %q on segment %d: %w", key, seg.id, err)
 	}
 
+	// the previous value won't be read anymore
+	if old, ok := db.index.get(key); ok {
+		db.valueCache.remove(old)
+	}
+
 	// add current key's location to index
 	// offset equals size since we're appending to the file
 	// if power is lost just before this line, no prob,
 	// index will be rebuilt anyway
-	db.index[key] = &recordLocation{seg: seg, offset: off}
+	db.index.put(key, recordLocation{segId: uint32(seg.id), valSize: uint32(len(val)), offset: off})
+	db.tombstones.delete(key)
+	delete(db.corruptKeys, key)
+	db.notify(TypeSet, key, val, seg.id, off)
+
+	// the record is written, it's indexed again when the db is reopened
+	if err := db.indexErr(); err != nil {
+		return fmt.Errorf("index key %q: %w", key, err)
+	}
 
 	if err = db.checkRolloverAndMerge(seg); err != nil {
 		return err
@@ -385,7 +578,10 @@ func (db *DB) Delete(key string) error {
 	db.rw.Lock()
 	defer db.rw.Unlock()
 
-	_, ok := db.index[key]
+	loc, ok := db.index.get(key)
+	if err := db.index.err(); err != nil {
+		return fmt.Errorf("look up key %q: %w", key, err)
+	}
 	if !ok {
 		return fmt.Errorf("%w: %q", ErrKeyNotFound, key)
 	}
@@ -393,14 +589,25 @@ func (db *DB) Delete(key string) error {
 	// get active segment
 	seg := db.segments[len(db.segments)-1]
 
-	if _, err := seg.write(key, "", TypeDelete, db.fsync); err != nil {
+	off, err := seg.write(key, "", TypeDelete, db.writeTime(), db.fsync)
+	if err != nil {
 		return fmt.Errorf("write key %q on segment %d: %w", key, seg.id, err)
 	}
 
 	// delete the key. this makes get calls on deleted keys more efficient
-	delete(db.index, key)
+	db.index.delete(key)
+	db.valueCache.remove(loc)
+	delete(db.corruptKeys, key)
+
+	// keep track of the tombstone so merge can decide whether to carry it over
+	db.tombstones.put(key, recordLocation{segId: uint32(seg.id), offset: off})
+	db.notify(TypeDelete, key, "", seg.id, off)
+
+	if err := db.indexErr(); err != nil {
+		return fmt.Errorf("index key %q: %w", key, err)
+	}
 
-	if err := db.checkRolloverAndMerge(seg); err != nil {
+	if err = db.checkRolloverAndMerge(seg); err != nil {
 		return err
 	}
 
@@ -422,36 +629,3 @@ func (db *DB) DiskSize() (int64, error) {
 	}
 	return total, nil
 }
-
-// We check orphaned segments in case a power loss occurred during a merge operation
-func (db *DB) checkOrphanedSegments(segIds []int) error {
-	// scan directory for segment files
-	entries, err := os.ReadDir(db.dir)
-	if err != nil {
-		return fmt.Errorf("read dir: %w", err)
-	}
-
-	// segment ids in the manifest
-	expected := mapset.NewSet[string]()
-	for _, id := range segIds {
-		// seg001, seg002, ...
-		expected.Add(fmt.Sprintf("seg%03d", id))
-	}
-
-	// actual segment files
-	actual := mapset.NewSet[string]()
-	for _, entry := range entries {
-		name := entry.Name()
-		if entry.IsDir() || name[:3] != "seg" {
-			continue
-		}
-
-		actual.Add(name)
-	}
-
-	if res := actual.Difference(expected); res.Cardinality() != 0 {
-		log.Printf("warning: orphaned segments exist: %v", res)
-	}
-
-	return nil
-}
@@ -8,7 +8,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+
+	"github.com/zeebo/xxh3"
 )
 
 func TestSetAndGet(t *testing.T) {
@@ -113,7 +116,7 @@ func TestTruncatedHeader(t *testing.T) {
 	_, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
 
 	// Manually write a valid record + truncated second record
-	f, _ := os.Create(filepath.Join(dir, "seg001"))
+	f, _ := os.Create(getSegmentPath(dir, 1))
 	// Write one good record
 	_, _ = writeRecord(f, TypeSet, "k", "v")
 
@@ -136,15 +139,15 @@ func TestTruncatedHeader(t *testing.T) {
 	}
 
 	// second key should not be indexed
-	if len(db.index) != 1 {
-		t.Errorf("expected 1 entry, got index %v", db.index)
+	if db.index.len() != 1 {
+		t.Errorf("expected 1 entry, got %d", db.index.len())
 	}
 }
 
 func TestTruncatedKey(t *testing.T) {
 	_, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
 
-	f, _ := os.Create(filepath.Join(dir, "seg001"))
+	f, _ := os.Create(getSegmentPath(dir, 1))
 
 	// write one good record
 	_, _ = writeRecord(f, TypeSet, "k", "v")
@@ -169,8 +172,8 @@ func TestTruncatedKey(t *testing.T) {
 	}
 
 	// second key should not be indexed
-	if len(db.index) != 1 {
-		t.Errorf("expected 1 entry, got index %v", db.index)
+	if db.index.len() != 1 {
+		t.Errorf("expected 1 entry, got %d", db.index.len())
 	}
 
 }
@@ -178,7 +181,7 @@ func TestTruncatedKey(t *testing.T) {
 func TestTruncatedValue(t *testing.T) {
 	_, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
 
-	f, _ := os.Create(filepath.Join(dir, "seg001"))
+	f, _ := os.Create(getSegmentPath(dir, 1))
 
 	// write one good record
 	_, _ = writeRecord(f, TypeSet, "k", "v")
@@ -327,9 +330,9 @@ func TestRecoveryAcrossSegmentBoundary(t *testing.T) {
 	_ = db.Set("foo", "C")
 
 	// ─── CRASH: truncate the segment containing C's record ───
-	loc := db.index["foo"]
+	loc, _ := db.index.get("foo")
 	off := loc.offset // where C's header would start
-	segPath := getSegmentPath(db.dir, loc.seg.id)
+	segPath := getSegmentPath(db.dir, int(loc.segId))
 
 	f, _ := os.OpenFile(segPath, os.O_WRONLY, 0)
 	_ = f.Truncate(off)
@@ -584,7 +587,7 @@ func TestDeletedKeysNotInIndexAfterReopen(t *testing.T) {
 
 	// Deleted key should not exist in index after restart
 	db2.rw.RLock()
-	_, exists := db2.index["a"]
+	_, exists := db2.index.get("a")
 	db2.rw.RUnlock()
 	if exists {
 		t.Errorf("deleted key 'a' should not exist in index after restart")
@@ -608,8 +611,8 @@ func TestCorruptionDetection(t *testing.T) {
 	}
 
 	// Step 3: Corrupt the record while DB is open
-	f, _ := os.OpenFile(filepath.Join(dir, "seg001"), os.O_WRONLY, 0644)
-	_, _ = f.Seek(hdrLen+4, 0) // 4 = len("test")
+	f, _ := os.OpenFile(getSegmentPath(dir, 1), os.O_WRONLY, 0644)
+	_, _ = f.Seek(segHdrLen+hdrLen+4, 0) // 4 = len("test")
 	_, _ = f.WriteString("CORRUPTED12")
 	_ = f.Close()
 
@@ -643,3 +646,377 @@ func TestCorruptionDetection(t *testing.T) {
 		t.Fatalf("Expected checksum mismatch error, got: %v", err)
 	}
 }
+
+// TestRecordScannerHeaderMode reads records key-first, skipping some values and
+// copying others raw, and checks the raw bytes match the original encoding.
+func TestRecordScannerHeaderMode(t *testing.T) {
+	var buf bytes.Buffer
+	var encoded [][]byte
+	for _, kv := range [][2]string{{"a", "skipped"}, {"b", "kept"}, {"c", ""}} {
+		var rec bytes.Buffer
+		_, _ = writeRecord(&rec, TypeSet, kv[0], kv[1])
+		encoded = append(encoded, rec.Bytes())
+		buf.Write(rec.Bytes())
+	}
+
+	rs := newRecordScanner(bytes.NewReader(buf.Bytes()), true)
+
+	var offs []int64
+	for i := 0; rs.scanHeader(); i++ {
+		offs = append(offs, rs.off)
+
+		// only read the value of "b", the rest is skipped
+		if string(rs.key) != "b" {
+			continue
+		}
+
+		if !rs.readValue() {
+			t.Fatalf("readValue failed: %v", rs.err)
+		}
+		if !bytes.Equal(rs.raw(), encoded[i]) {
+			t.Fatalf("raw record mismatch: got %v, want %v", rs.raw(), encoded[i])
+		}
+	}
+
+	if rs.err != nil {
+		t.Fatalf("scan: %v", rs.err)
+	}
+
+	want := []int64{0, int64(len(encoded[0])), int64(len(encoded[0]) + len(encoded[1]))}
+	if fmt.Sprint(offs) != fmt.Sprint(want) {
+		t.Fatalf("offsets %v, want %v", offs, want)
+	}
+
+	if rs.end != int64(buf.Len()) {
+		t.Fatalf("end offset %d, want %d", rs.end, buf.Len())
+	}
+}
+
+// TestParallelLoadKeepsManifestOrder overwrites keys across many segments and
+// reopens with several load workers. Later segments must win regardless of
+// which worker finishes first, and progress is reported once per segment.
+func TestParallelLoadKeepsManifestOrder(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(64), WithMergeEnabled(false))
+
+	for round := 0; round < 10; round++ {
+		for k := 0; k < 20; k++ {
+			_ = db.Set(fmt.Sprintf("k%02d", k), fmt.Sprintf("v%d", round))
+		}
+		_ = db.Delete("k00")
+	}
+	segCount := len(db.segments)
+	_ = db.Close()
+
+	var progress []int
+	db2, err := Open(dir,
+		WithMergeEnabled(false),
+		WithLoadWorkers(4),
+		WithLoadProgress(func(loaded, total int) {
+			if total != segCount {
+				t.Errorf("progress total %d, want %d", total, segCount)
+			}
+			progress = append(progress, loaded)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	for i, loaded := range progress {
+		if loaded != i+1 {
+			t.Fatalf("progress out of order: %v", progress)
+		}
+	}
+	if len(progress) != segCount {
+		t.Fatalf("expected %d progress calls, got %d", segCount, len(progress))
+	}
+
+	if _, err := db2.Get("k00"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected k00 to be deleted, got %v", err)
+	}
+	for k := 1; k < 20; k++ {
+		if v, err := db2.Get(fmt.Sprintf("k%02d", k)); err != nil || v != "v9" {
+			t.Errorf("expected k%02d=v9, got %q, %v", k, v, err)
+		}
+	}
+}
+
+// TestParallelLoadFailure corrupts a segment in the middle and expects
+// Open to fail with the checksum error while other segments load fine.
+func TestParallelLoadFailure(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+
+	for i := 0; i < 8; i++ {
+		_ = db.Set(fmt.Sprintf("k%d", i), "value")
+	}
+	corrupted := db.segments[3].id
+	_ = db.Close()
+
+	f, _ := os.OpenFile(getSegmentPath(dir, corrupted), os.O_WRONLY, 0o644)
+	_, _ = f.WriteAt([]byte("X"), segHdrLen+hdrLen)
+	_ = f.Close()
+
+	_, err := Open(dir, WithMergeEnabled(false), WithLoadWorkers(3))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestStatsIndexMemory(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithMergeEnabled(false))
+
+	for i := 0; i < 100; i++ {
+		_ = db.Set(fmt.Sprintf("key%03d", i), "value")
+	}
+	_ = db.Set("key000", "overwritten") // doesn't add a new entry
+	for i := 0; i < 10; i++ {
+		_ = db.Delete(fmt.Sprintf("key%03d", i))
+	}
+
+	st := db.Stats()
+	if st.Keys != 90 || st.Tombstones != 10 || st.Segments != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// every entry holds a 6 byte key
+	if want := int64(100 * (6 + keydirEntryOverhead)); st.IndexBytes != want {
+		t.Fatalf("expected index memory %d, got %d", want, st.IndexBytes)
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	opts := []Option{WithRolloverThreshold(100), WithMergeEnabled(false), WithMmapReads(true)}
+	db, dir, _ := SetupTempDB(t, opts...)
+
+	fillCheckpointDB(t, db)
+	checkCheckpointDB(t, db)
+
+	// all but the active segment get mapped on rollover
+	for i, seg := range db.segments {
+		if isActive := i == len(db.segments)-1; isActive != (seg.data == nil) {
+			t.Fatalf("segment %d: unexpected mapping state, mapped=%v", seg.id, seg.data != nil)
+		}
+	}
+	_ = db.Close()
+
+	db2, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if db2.segments[0].data == nil {
+		t.Fatalf("expected inactive segments to be mapped on Open")
+	}
+	checkCheckpointDB(t, db2)
+
+	// mapped reads verify checksums and bounds too
+	loc, _ := db2.index.get("k01")
+	data := bytes.Clone(db2.segById[int(loc.segId)].data)
+	data[loc.offset+hdrLen+3] ^= 0xff
+	if _, _, err := decodeRecord(data, loc.offset, true); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if _, _, err := decodeRecord(data[:loc.offset+hdrLen], loc.offset, true); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestValueCache(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithMergeEnabled(false), WithValueCache(1024))
+
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "1")
+
+	for i := 0; i < 3; i++ {
+		if v, err := db.Get("a"); err != nil || v != "1" {
+			t.Fatalf("expected a=1, got %q, %v", v, err)
+		}
+	}
+	if st := db.Stats(); st.CacheHits != 2 || st.CacheMisses != 1 || st.CacheBytes != 1+lruEntryOverhead {
+		t.Fatalf("unexpected cache stats: %+v", st)
+	}
+
+	// overwritten and deleted values must not be served from the cache
+	_ = db.Set("a", "2")
+	if v, err := db.Get("a"); err != nil || v != "2" {
+		t.Fatalf("expected a=2, got %q, %v", v, err)
+	}
+	_ = db.Delete("a")
+	if _, err := db.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected a to be deleted, got %v", err)
+	}
+	if st := db.Stats(); st.CacheBytes != 0 {
+		t.Fatalf("expected invalidated entries to be removed, cache holds %d bytes", st.CacheBytes)
+	}
+
+	// the budget is in bytes, a value that doesn't fit is not cached
+	_ = db.Set("big", string(make([]byte, 2048)))
+	_, _ = db.Get("big")
+	_, _ = db.Get("big")
+	if st := db.Stats(); st.CacheHits != 2 || st.CacheMisses != 4 {
+		t.Fatalf("unexpected cache stats: %+v", st)
+	}
+}
+
+func TestSegmentHeader(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	hdr := db.segments[0].hdr
+	_ = db.Close()
+
+	if hdr.version != segmentVersion || hdr.checksumAlgo != checksumXXH3 || hdr.flags != 0 {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+
+	db2, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := db2.segments[0].hdr; !got.createdAt.Equal(hdr.createdAt) || got.version != hdr.version {
+		t.Fatalf("expected header %+v after reopen, got %+v", hdr, got)
+	}
+	_ = db2.Close()
+
+	path := getSegmentPath(dir, 1)
+	data, _ := os.ReadFile(path)
+
+	// an unknown version is rejected, even with a valid header checksum
+	future := bytes.Clone(data)
+	binary.LittleEndian.PutUint16(future[len(segmentMagic):], segmentVersion+1)
+	binary.LittleEndian.PutUint64(future[segHdrLen-csLen:], xxh3.Hash(future[:segHdrLen-csLen]))
+	_ = os.WriteFile(path, future, 0o644)
+	if _, err := Open(dir, WithMergeEnabled(false)); !errors.Is(err, ErrBadSegmentHeader) {
+		t.Fatalf("expected bad segment header for unknown version, got %v", err)
+	}
+
+	// and so is a corrupted header
+	corrupted := bytes.Clone(data)
+	corrupted[len(segmentMagic)+4] ^= 0xff
+	_ = os.WriteFile(path, corrupted, 0o644)
+	if _, err := Open(dir, WithMergeEnabled(false)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch for corrupted header, got %v", err)
+	}
+
+	// a header cut short before any record is an empty new segment
+	_ = os.WriteFile(path, data[:12], 0o644)
+	db3, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open with a short header: %v", err)
+	}
+	if seg := db3.segments[0]; seg.hdr.version != segmentVersion || seg.size != segHdrLen {
+		t.Fatalf("expected an empty segment with a header, got %+v of %d bytes", seg.hdr, seg.size)
+	}
+	_ = db3.Set("b", "2")
+	_ = db3.Close()
+
+	db4, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("reopen after the short header: %v", err)
+	}
+	defer db4.Close() // nolint:errcheck
+	if v, err := db4.Get("b"); err != nil || v != "2" || db4.segments[0].hdr.version != segmentVersion {
+		t.Fatalf("expected b=2 in a segment with a header, got %q, %v", v, err)
+	}
+}
+
+// TestLegacySegments opens segments written before the segment header
+// existed, next to new ones, and keeps writing to the legacy one.
+func TestLegacySegments(t *testing.T) {
+	dir := t.TempDir()
+
+	var legacy bytes.Buffer
+	_, _ = writeRecord(&legacy, TypeSet, "a", "1")
+	_, _ = writeRecord(&legacy, TypeSet, "b", "1")
+	_ = os.WriteFile(getSegmentPath(dir, 1), legacy.Bytes(), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "MANIFEST"), []byte("1\n"), 0o644)
+
+	db, err := Open(dir, WithRolloverThreshold(3*(hdrLen+2)), WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open legacy: %v", err)
+	}
+	defer db.Close() // nolint:errcheck
+
+	if seg := db.segments[0]; seg.hdr.version != 0 || seg.dataSize() != seg.size {
+		t.Fatalf("expected a legacy segment, got header %+v", seg.hdr)
+	}
+
+	_ = db.Set("b", "2") // legacy segment rolls over
+	_ = db.Set("c", "2")
+	if len(db.segments) != 2 || db.segments[1].hdr.version != segmentVersion {
+		t.Fatalf("expected a new segment with a header after the legacy one")
+	}
+
+	for k, want := range map[string]string{"a": "1", "b": "2", "c": "2"} {
+		if v, err := db.Get(k); err != nil || v != want {
+			t.Errorf("expected %s=%s, got %q, %v", k, want, v, err)
+		}
+	}
+}
+
+func TestParseSegmentName(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		id     int
+		legacy bool
+		ok     bool
+	}{
+		{"0000000007.seg", 7, false, true},
+		{"0000001000.seg", 1000, false, true},
+		{"seg001", 1, true, true},
+		{"seg1234", 1234, true, true},
+		{"MANIFEST", 0, false, false},
+		{"se", 0, false, false},
+		{"seg", 0, false, false},
+		{".seg", 0, false, false},
+		{"seg001.tmp", 0, false, false},
+		{"-1.seg", 0, false, false},
+		{"1.seg", 0, false, false},
+		{"00000000007.seg", 0, false, false},
+		{"segments", 0, false, false},
+	} {
+		id, legacy, ok := parseSegmentName(tc.name)
+		if id != tc.id || legacy != tc.legacy || ok != tc.ok {
+			t.Errorf("%q: expected %d %v %v, got %d %v %v", tc.name, tc.id, tc.legacy, tc.ok, id, legacy, ok)
+		}
+	}
+
+	if got := segmentFileName(1234); got != "0000001234.seg" {
+		t.Errorf("unexpected segment file name %q", got)
+	}
+}
+
+// TestLegacySegmentNamesMigrated opens a directory that uses the old naming
+// scheme, with ids past 999 that don't sort by name.
+func TestLegacySegmentNamesMigrated(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, id := range []int{999, 1000} {
+		var rec bytes.Buffer
+		_, _ = writeRecord(&rec, TypeSet, "k", fmt.Sprintf("v%d", id))
+		_ = os.WriteFile(filepath.Join(dir, fmt.Sprintf("seg%03d", id)), rec.Bytes(), 0o644)
+	}
+	_ = os.WriteFile(filepath.Join(dir, "MANIFEST"), []byte("999\n1000\n"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("unrelated"), 0o644)
+
+	db, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close() // nolint:errcheck
+
+	if v, err := db.Get("k"); err != nil || v != "v1000" {
+		t.Fatalf("expected k=v1000, got %q, %v", v, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"0000000999.seg", "0000001000.seg", "MANIFEST", "notes.txt"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("expected files %v, got %v", want, names)
+	}
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/zeebo/xxh3"
+)
+
+// WithSkipCorrupted makes Open skip corrupted regions of segments instead of
+// failing. Scanning resumes at the next record with a valid checksum, the
+// records in between are lost. Skipped regions are logged and listed by
+// Corruptions, they are left in place so they can be inspected or repaired.
+func WithSkipCorrupted(b bool) Option {
+	return func(db *DB) { db.skipCorrupted = b }
+}
+
+// Corruptions returns the corrupted regions skipped by Open
+func (db *DB) Corruptions() []Corruption {
+	db.rw.RLock()
+	defer db.rw.RUnlock()
+
+	return slices.Clone(db.corruptions)
+}
+
+// resyncWindow is how much of a segment findNextRecord reads at a time
+const resyncWindow = 64 * 1024
+
+// findNextRecord returns the offset of the first record after off that's
+// complete and has a valid checksum, or end if there's none before end.
+// The record at off is assumed to be corrupted, its lengths aren't trusted
+// beyond a first guess.
+func findNextRecord(r io.ReaderAt, off, end int64) (int64, error) {
+	if end-off <= hdrLen {
+		return end, nil
+	}
+
+	var hdr [hdrLen]byte
+	if _, err := r.ReadAt(hdr[:], off); err != nil {
+		return 0, fmt.Errorf("read at %d: %w", off, err)
+	}
+
+	// only the value may be damaged, then the next record is right after it
+	_, keyLen, valLen, _ := parseHeader(hdr)
+	if next := off + int64(hdrLen+keyLen+valLen); next < end {
+		ok, err := validRecordAt(r, next, end)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return next, nil
+		}
+	}
+
+	// every offset is a candidate. the segment is read in windows that
+	// overlap by a header, candidates that don't fit one are read apart
+	buf := make([]byte, min(resyncWindow, end-off))
+	for base := off + 1; end-base >= hdrLen; {
+		w := buf[:min(int64(len(buf)), end-base)]
+		if _, err := r.ReadAt(w, base); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("read at %d: %w", base, err)
+		}
+
+		for p := 0; p+hdrLen <= len(w); p++ {
+			at := base + int64(p)
+			checksum, total, ok := plausibleRecord([hdrLen]byte(w[p:]), end-at)
+			if !ok {
+				continue
+			}
+
+			if int64(p)+total <= int64(len(w)) {
+				if xxh3.Hash(w[p+csLen:int64(p)+total]) == checksum {
+					return at, nil
+				}
+				continue
+			}
+
+			valid, err := checksumAt(r, at, total, checksum)
+			if err != nil {
+				return 0, err
+			}
+			if valid {
+				return at, nil
+			}
+		}
+
+		base += int64(len(w) - hdrLen + 1)
+	}
+
+	return end, nil
+}
+
+// plausibleRecord checks the header of a candidate record with room bytes
+// left in the segment. It returns the checksum and the length of the record.
+func plausibleRecord(hdr [hdrLen]byte, room int64) (uint64, int64, bool) {
+	checksum, keyLen, valLen, wt := parseHeader(hdr)
+
+	total := int64(hdrLen) + int64(keyLen) + int64(valLen)
+	if total > room {
+		return 0, 0, false
+	}
+
+	flags := hdr[hdrLen-1]
+	if flags&^recFlagTimestamp != 0 || (flags&recFlagTimestamp != 0 && valLen < tsLen) {
+		return 0, 0, false
+	}
+
+	// tombstones have no value, besides the timestamp
+	switch wt {
+	case TypeSet:
+	case TypeDelete:
+		if valLen != 0 && valLen != tsLen {
+			return 0, 0, false
+		}
+	default:
+		return 0, 0, false
+	}
+
+	return checksum, total, true
+}
+
+// validRecordAt reports whether there's a complete record with a valid checksum at off
+func validRecordAt(r io.ReaderAt, off, end int64) (bool, error) {
+	if end-off < hdrLen {
+		return false, nil
+	}
+
+	var hdr [hdrLen]byte
+	if _, err := r.ReadAt(hdr[:], off); err != nil {
+		return false, fmt.Errorf("read at %d: %w", off, err)
+	}
+
+	checksum, total, ok := plausibleRecord(hdr, end-off)
+	if !ok {
+		return false, nil
+	}
+
+	return checksumAt(r, off, total, checksum)
+}
+
+// checksumAt reports whether the record of length total at off has the
+// checksum. It's streamed, so lengths of corrupted records can't blow up memory.
+func checksumAt(r io.ReaderAt, off, total int64, checksum uint64) (bool, error) {
+	h := xxh3.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, off+csLen, total-csLen)); err != nil {
+		return false, fmt.Errorf("read record at %d: %w", off, err)
+	}
+	return h.Sum64() == checksum, nil
+}
+
+// validRanges returns the regions of the segment that hold records,
+// everything but the header and the regions skipped on Open
+func (s *segment) validRanges() [][2]int64 {
+	var ranges [][2]int64
+
+	off := s.hdr.len()
+	for _, c := range s.lost {
+		if c.Offset > off {
+			ranges = append(ranges, [2]int64{off, c.Offset})
+		}
+		off = c.Offset + c.Length
+	}
+
+	if off < s.size {
+		ranges = append(ranges, [2]int64{off, s.size})
+	}
+
+	return ranges
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupCorrupted writes a, b and c to a single segment and corrupts the record of key
+// with damage, which gets the offset of the record in the segment file
+func setupCorrupted(t *testing.T, key string, damage func(f *os.File, off int64)) (dir string, loc recordLocation) {
+	t.Helper()
+
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
+	for _, k := range []string{"a", "b", "c"} {
+		_ = db.Set(k, "value")
+	}
+	loc, _ = db.index.get(key)
+	_ = db.Close()
+
+	f, _ := os.OpenFile(getSegmentPath(dir, int(loc.segId)), os.O_WRONLY, 0o644)
+	damage(f, loc.offset)
+	_ = f.Close()
+
+	return dir, loc
+}
+
+func corruptRecordValue(f *os.File, off int64) {
+	_, _ = f.WriteAt([]byte("X"), off+hdrLen+1)
+}
+
+func TestSkipCorruptedValue(t *testing.T) {
+	dir, loc := setupCorrupted(t, "b", corruptRecordValue)
+
+	if _, err := Open(dir, WithMergeEnabled(false)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	db, err := Open(dir, WithMergeEnabled(false), WithSkipCorrupted(true))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close() // nolint:errcheck
+
+	cs := db.Corruptions()
+	if len(cs) != 1 || cs[0].Segment != int(loc.segId) || cs[0].Offset != loc.offset ||
+		cs[0].Length != hdrLen+1+5 || !errors.Is(cs[0].Err, ErrChecksumMismatch) {
+		t.Fatalf("unexpected corruptions: %+v", cs)
+	}
+
+	if _, err := db.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected b to be lost, got %v", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if v, err := db.Get(k); err != nil || v != "value" {
+			t.Fatalf("expected %s=value, got %q, %v", k, v, err)
+		}
+	}
+
+	// merge leaves the skipped region out
+	db.rw.Lock()
+	_ = db.rolloverSegment()
+	db.rw.Unlock()
+
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if v, err := db.Get(k); err != nil || v != "value" {
+			t.Fatalf("expected %s=value after merge, got %q, %v", k, v, err)
+		}
+	}
+	if found, err := db.Scrub(); err != nil || len(found) != 0 {
+		t.Fatalf("expected merged segment to be intact, got %+v, %v", found, err)
+	}
+	if cs := db.Corruptions(); len(cs) != 0 {
+		t.Fatalf("expected the corruptions to go with the merged segment, got %+v", cs)
+	}
+}
+
+// TestFindNextRecordFar resyncs over garbage larger than the read window
+func TestFindNextRecordFar(t *testing.T) {
+	garbage := make([]byte, 3*resyncWindow+5)
+	rand.New(rand.NewSource(1)).Read(garbage)
+
+	var buf bytes.Buffer
+	buf.Write(garbage)
+	_, _ = writeRecord(&buf, TypeSet, "key", "value")
+	buf.Write(garbage[:100])
+
+	r := bytes.NewReader(buf.Bytes())
+	if next, err := findNextRecord(r, 0, r.Size()); err != nil || next != int64(len(garbage)) {
+		t.Fatalf("expected the record at %d, got %d, %v", len(garbage), next, err)
+	}
+
+	// no record after the window, the rest is lost
+	if next, err := findNextRecord(r, int64(len(garbage))+1, r.Size()); err != nil || next != r.Size() {
+		t.Fatalf("expected no record, got %d, %v", next, err)
+	}
+}
+
+func TestSkipCorruptedDropsCheckpoint(t *testing.T) {
+	dir, _ := setupCorrupted(t, "b", corruptRecordValue)
+
+	// a checkpoint of an older state, it's ignored on Open
+	path := filepath.Join(dir, checkpointName)
+	_ = os.WriteFile(path, []byte("stale"), 0o644)
+
+	db, err := Open(dir, WithMergeEnabled(false), WithSkipCorrupted(true), WithCheckpoint(true))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if len(db.Corruptions()) != 1 {
+		t.Fatalf("expected a corruption, got %+v", db.Corruptions())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale checkpoint to be removed, got %v", err)
+	}
+}
+
+func TestSkipCorruptedHeader(t *testing.T) {
+	// a huge key length makes the record run past the end of the file
+	dir, loc := setupCorrupted(t, "b", func(f *os.File, off int64) {
+		_, _ = f.WriteAt(binary.LittleEndian.AppendUint32(nil, 1<<30), off+csLen)
+	})
+
+	db, err := Open(dir, WithMergeEnabled(false), WithSkipCorrupted(true))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close() // nolint:errcheck
+
+	if cs := db.Corruptions(); len(cs) != 1 || cs[0].Offset != loc.offset || cs[0].Length != hdrLen+1+5 {
+		t.Fatalf("unexpected corruptions: %+v", cs)
+	}
+	if v, err := db.Get("c"); err != nil || v != "value" {
+		t.Fatalf("expected c=value, got %q, %v", v, err)
+	}
+}
+
+func TestSkipCorruptedTail(t *testing.T) {
+	dir, loc := setupCorrupted(t, "c", corruptRecordValue)
+
+	db, err := Open(dir, WithMergeEnabled(false), WithSkipCorrupted(true))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	// the corrupted bytes are kept, new records go after them
+	seg := db.segments[len(db.segments)-1]
+	if cs := db.Corruptions(); len(cs) != 1 || cs[0].Offset+cs[0].Length != seg.size {
+		t.Fatalf("expected corruption up to the end of the segment, got %+v", cs)
+	}
+	if seg.size != loc.offset+hdrLen+1+5 {
+		t.Fatalf("expected corrupted tail to be kept, size %d", seg.size)
+	}
+
+	_ = db.Set("d", "value")
+	_ = db.Close()
+
+	db, err = Open(dir, WithMergeEnabled(false), WithSkipCorrupted(true))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close() // nolint:errcheck
+
+	if v, err := db.Get("d"); err != nil || v != "value" {
+		t.Fatalf("expected d=value, got %q, %v", v, err)
+	}
+	if cs := db.Corruptions(); len(cs) != 1 || cs[0].Offset != loc.offset {
+		t.Fatalf("unexpected corruptions: %+v", cs)
+	}
+}
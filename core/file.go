@@ -11,8 +11,30 @@ import (
 // renaming it over the old path, then fsyncing the directory.
 //
 // It returns the pointer to the new file handle.
-func writeFileAtomic(f *os.File, data []byte) (retf *os.File, rerr error) {
+func writeFileAtomic(f *os.File, data []byte) (*os.File, error) {
 	path := f.Name()
+
+	if err := replaceFileAtomic(path, data); err != nil {
+		return nil, err
+	}
+
+	// Close the old file handle
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	// Create new file handle that will be returned
+	retf, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return retf, nil
+}
+
+// replaceFileAtomic atomically creates or replaces the file at path with the
+// full contents of data, the same way writeFileAtomic does.
+func replaceFileAtomic(path string, data []byte) (rerr error) {
 	tmpPath := path + ".tmp"
 
 	// on error, remove tmp file
@@ -28,63 +50,41 @@ func writeFileAtomic(f *os.File, data []byte) (retf *os.File, rerr error) {
 	// assuming {path}.tmp does not exist, else we will error out
 	tmpf, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// on error, remove tmp file handle
+	// Close tmp file handle at the end, it's not needed after rename
 	defer func() {
-		if rerr != nil {
-			if err := tmpf.Close(); err != nil {
-				log.Printf("close temp file %q: %v", tmpf.Name(), err)
-			}
+		if err := tmpf.Close(); err != nil {
+			log.Printf("close temp file %q: %v", tmpf.Name(), err)
 		}
 	}()
 
 	// Write all bytes at once
 	if _, err = tmpf.Write(data); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Sync the temp file to ensure data is on disk
 	if err = tmpf.Sync(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Atomically rename temp file to its intended name
 	if err = os.Rename(tmpPath, path); err != nil {
-		return nil, err
-	}
-
-	// Close the old file handle
-	if err = f.Close(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Finally, fsync the directory so the rename itself is durable
 	dir := filepath.Dir(path)
 	d, err := os.Open(dir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer d.Close() // nolint:errcheck
 
-	if err = d.Sync(); err != nil {
-		return nil, err
-	}
-
-	// Close tmp file handle because it points to wrong path
-	if err := tmpf.Close(); err != nil {
-		log.Printf("close temp file %q: %v", tmpf.Name(), err)
-	}
-
-	// Create new file handle that will be returned
-	retf, err = os.OpenFile(path, os.O_RDWR, 0o644)
-	if err != nil {
-		return nil, err
-	}
-
-	return retf, nil
+	return d.Sync()
 }
 
 func createFileDurable(dir, name string) (*os.File, error) {
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Inspection reads the files of a data directory without opening the
+// database. The directory is never modified, and it's fine for the database
+// to be open meanwhile, though the results may be slightly behind.
+
+// SegmentInfo describes a segment listed in the MANIFEST
+type SegmentInfo struct {
+	Id         int    `json:"id"`
+	File       string `json:"file"`
+	Size       int64  `json:"size"`    // size of the file, including the header
+	Records    int64  `json:"records"` // counted by scanning the active segment
+	Generation int    `json:"generation"`
+	Version    uint16 `json:"version"` // segment format version, 0 for legacy segments
+	Sealed     bool   `json:"sealed"`
+	Merged     bool   `json:"merged"`
+}
+
+// RecordInfo describes a record of a segment
+type RecordInfo struct {
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"` // length of the record, or of the unreadable bytes
+	Type     string `json:"type,omitempty"`
+	Key      string `json:"key,omitempty"`
+	ValueLen int    `json:"value_len"`
+	Status   string `json:"status"` // RecordOK, RecordChecksumMismatch or RecordUnreadable
+}
+
+// record statuses reported by DumpSegment
+const (
+	RecordOK               = "ok"
+	RecordChecksumMismatch = "checksum mismatch"
+	RecordUnreadable       = "unreadable" // bytes up to the next valid record, they can't be parsed
+)
+
+// SegmentUsage is the share of a segment that's still live
+type SegmentUsage struct {
+	Id        int   `json:"id"`
+	Records   int64 `json:"records"`
+	Live      int64 `json:"live"` // records that are the latest value of their key
+	Bytes     int64 `json:"bytes"`
+	LiveBytes int64 `json:"live_bytes"`
+}
+
+// ListSegments returns the segments of the database in dir, in MANIFEST order
+func ListSegments(dir string) ([]SegmentInfo, error) {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := readManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SegmentInfo, 0, len(st.segs))
+	for _, m := range st.segs {
+		info := SegmentInfo{
+			Id:         m.id,
+			File:       files[m.id],
+			Records:    m.records,
+			Generation: m.generation,
+			Sealed:     m.sealed(),
+			Merged:     m.flags&metaMerged != 0,
+		}
+
+		if info.File == "" {
+			return nil, fmt.Errorf("segment %d: %w", m.id, os.ErrNotExist)
+		}
+
+		err := withSegmentFile(dir, info.File, func(f *os.File, hdr segmentHeader, size int64) error {
+			info.Size, info.Version = size, hdr.version
+			if info.Sealed {
+				return nil
+			}
+
+			// the manifest doesn't count the records of the active segment
+			rs := newRecordScannerRange(f, hdr.len(), size, false)
+			for rs.scanHeader() {
+				info.Records++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", m.id, err)
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// DumpSegment calls fn for each record of segment id in dir, verifying its
+// checksum. Corrupted bytes don't stop the dump, it resumes at the next valid record.
+func DumpSegment(dir string, id int, fn func(RecordInfo) error) error {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	name, ok := files[id]
+	if !ok {
+		return fmt.Errorf("segment %d: %w", id, os.ErrNotExist)
+	}
+
+	return withSegmentFile(dir, name, func(f *os.File, hdr segmentHeader, size int64) error {
+		off := hdr.len()
+		for off < size {
+			rs := newRecordScannerRange(f, off, size, true)
+			for rs.scan() {
+				rec := rs.record
+				if err := fn(RecordInfo{
+					Offset:   rec.off,
+					Length:   rs.end - rec.off,
+					Type:     rec.wt.String(),
+					Key:      rec.key,
+					ValueLen: rec.valSize,
+					Status:   RecordOK,
+				}); err != nil {
+					return err
+				}
+			}
+
+			if rs.err == nil && rs.end == size {
+				return nil
+			}
+			if rs.err != nil && !errors.Is(rs.err, ErrChecksumMismatch) && !errors.Is(rs.err, errRecordOutOfRange) {
+				return rs.err
+			}
+
+			info := RecordInfo{Offset: rs.end, Status: RecordUnreadable}
+			if errors.Is(rs.err, ErrChecksumMismatch) {
+				info = RecordInfo{
+					Offset:   rs.off,
+					Type:     rs.wt.String(),
+					Key:      string(rs.key),
+					ValueLen: rs.valSize(),
+					Status:   RecordChecksumMismatch,
+				}
+			}
+
+			next, err := findNextRecord(f, info.Offset, size)
+			if err != nil {
+				return err
+			}
+
+			info.Length = next - info.Offset
+			if err := fn(info); err != nil {
+				return err
+			}
+			off = next
+		}
+
+		return nil
+	})
+}
+
+// ListSegmentUsage returns how much of each segment is live, in MANIFEST order.
+// It replays all records the way Open does, so it needs memory for every key.
+func ListSegmentUsage(dir string) ([]SegmentUsage, error) {
+	infos, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type latest struct {
+		seg  int // index in usage
+		size int64
+	}
+	index := make(map[string]latest)
+	usage := make([]SegmentUsage, len(infos))
+
+	for i, info := range infos {
+		u := &usage[i]
+		u.Id = info.Id
+
+		err := withSegmentFile(dir, info.File, func(f *os.File, hdr segmentHeader, size int64) error {
+			rs := newRecordScannerRange(f, hdr.len(), size, false)
+			for rs.scanHeader() {
+				recLen := int64(hdrLen + len(rs.key) + rs.valLen)
+				u.Records++
+				u.Bytes += recLen
+
+				// the previous value of the key is dead now
+				key := string(rs.key)
+				if prev, ok := index[key]; ok {
+					usage[prev.seg].Live--
+					usage[prev.seg].LiveBytes -= prev.size
+					delete(index, key)
+				}
+
+				if rs.wt == TypeSet {
+					index[key] = latest{seg: i, size: recLen}
+					u.Live++
+					u.LiveBytes += recLen
+				}
+			}
+			return rs.err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", info.Id, err)
+		}
+	}
+
+	return usage, nil
+}
+
+// withSegmentFile opens the segment file name in dir read-only and
+// calls fn with its header and size
+func withSegmentFile(dir, name string, fn func(f *os.File, hdr segmentHeader, size int64) error) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := readSegmentHeader(f)
+	if err != nil {
+		return err
+	}
+
+	return fn(f, hdr, info.Size())
+}
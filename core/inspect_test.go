@@ -0,0 +1,96 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "2")
+	_ = db.Set("a", "3")
+	db.rw.Lock()
+	_ = db.rolloverSegment()
+	db.rw.Unlock()
+	_ = db.Delete("b")
+	loc, _ := db.index.get("a")
+
+	// the database can stay open while it's inspected
+	defer db.Close() // nolint:errcheck
+
+	segs, err := ListSegments(dir)
+	if err != nil {
+		t.Fatalf("list segments: %v", err)
+	}
+	if len(segs) != 2 || segs[0].Records != 3 || !segs[0].Sealed || segs[0].Version != segmentVersion ||
+		segs[1].Records != 1 || segs[1].Sealed || segs[1].File != segmentFileName(segs[1].Id) {
+		t.Fatalf("unexpected segments: %+v", segs)
+	}
+
+	usage, err := ListSegmentUsage(dir)
+	if err != nil {
+		t.Fatalf("list segment usage: %v", err)
+	}
+	if u := usage[0]; u.Records != 3 || u.Live != 1 || u.LiveBytes != hdrLen+2 || u.Bytes != 3*(hdrLen+2) {
+		t.Fatalf("unexpected usage of the first segment: %+v", u)
+	}
+	if u := usage[1]; u.Records != 1 || u.Live != 0 {
+		t.Fatalf("unexpected usage of the second segment: %+v", u)
+	}
+
+	// the first record is corrupted, the dump goes on after it
+	corruptAt(t, getSegmentPath(dir, segs[0].Id), segHdrLen+hdrLen+1)
+
+	var recs []RecordInfo
+	err = DumpSegment(dir, segs[0].Id, func(r RecordInfo) error {
+		recs = append(recs, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("dump segment: %v", err)
+	}
+
+	want := []RecordInfo{
+		{Offset: segHdrLen, Length: hdrLen + 2, Type: "set", Key: "a", ValueLen: 1, Status: RecordChecksumMismatch},
+		{Offset: segHdrLen + hdrLen + 2, Length: hdrLen + 2, Type: "set", Key: "b", ValueLen: 1, Status: RecordOK},
+		{Offset: loc.offset, Length: hdrLen + 2, Type: "set", Key: "a", ValueLen: 1, Status: RecordOK},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("expected %d records, got %+v", len(want), recs)
+	}
+	for i := range want {
+		if recs[i] != want[i] {
+			t.Fatalf("record %d: expected %+v, got %+v", i, want[i], recs[i])
+		}
+	}
+}
+
+func TestDumpTimestamped(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false), WithTimestamps(true))
+	_ = db.Set("a", "123")
+	_ = db.Delete("a")
+	defer db.Close() // nolint:errcheck
+
+	var recs []RecordInfo
+	err := DumpSegment(dir, db.segments[0].id, func(r RecordInfo) error {
+		recs = append(recs, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("dump segment: %v", err)
+	}
+
+	// the length of the value alone, the record carries the timestamp too
+	want := []RecordInfo{
+		{Offset: segHdrLen, Length: hdrLen + 1 + tsLen + 3, Type: "set", Key: "a", ValueLen: 3, Status: RecordOK},
+		{Offset: segHdrLen + hdrLen + 1 + tsLen + 3, Length: hdrLen + 1 + tsLen, Type: "delete", Key: "a", ValueLen: 0, Status: RecordOK},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("expected %d records, got %+v", len(want), recs)
+	}
+	for i := range want {
+		if recs[i] != want[i] {
+			t.Fatalf("record %d: expected %+v, got %+v", i, want[i], recs[i])
+		}
+	}
+}
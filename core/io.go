@@ -8,6 +8,7 @@ import (
 	"github.com/zeebo/xxh3"
 	"io"
 	"log"
+	"time"
 )
 
 type WriteType int8
@@ -17,19 +18,51 @@ const (
 	TypeSet
 )
 
-const hdrLen = 18 // 8B checksum + 4B keyLen + 4B valLen + 1 writeType + 1 reserved
+func (wt WriteType) String() string {
+	switch wt {
+	case TypeDelete:
+		return "delete"
+	case TypeSet:
+		return "set"
+	default:
+		return fmt.Sprintf("WriteType(%d)", int8(wt))
+	}
+}
+
+const hdrLen = 18 // 8B checksum + 4B keyLen + 4B valLen + 1 writeType + 1 flags
+
+// record flags, in the last byte of the header. it was reserved and always 0
+// before, so records of older versions have no flags.
+const (
+	recFlagTimestamp = 1 << iota // value starts with the 8-byte write time, unix nanos
+)
+
+const tsLen = 8 // timestamp length
 
 // todo think about using crc32c, it's 4B instead of 8
 const csLen = 8 // checksum length
 
 // writeRecord emits a record of:
 //
-//	[8-byte checksum][4-byte keyLen][4-byte valLen][1-byte writeType][1-byte reserved][key bytes][val bytes]
+//	[8-byte checksum][4-byte keyLen][4-byte valLen][1-byte writeType][1-byte flags][key bytes][val bytes]
 //
 // and returns the total length
 func writeRecord(w io.Writer, wt WriteType, key string, val string) (int64, error) {
+	return writeTimedRecord(w, wt, key, val, 0)
+}
+
+// writeTimedRecord is writeRecord with the write time ts in unix nanos, it's
+// stored in front of the value and counted in valLen. ts 0 leaves it out.
+func writeTimedRecord(w io.Writer, wt WriteType, key string, val string, ts int64) (int64, error) {
+	var flags byte
+	valLen := len(val)
+	if ts != 0 {
+		flags |= recFlagTimestamp
+		valLen += tsLen
+	}
+
 	// Build complete record in memory for single write
-	totalLen := hdrLen + len(key) + len(val)
+	totalLen := hdrLen + len(key) + valLen
 	buf := make([]byte, totalLen)
 
 	sb := buf // shrinking buffer
@@ -40,19 +73,24 @@ func writeRecord(w io.Writer, wt WriteType, key string, val string) (int64, erro
 	binary.LittleEndian.PutUint32(sb, uint32(len(key)))
 	sb = sb[4:]
 
-	binary.LittleEndian.PutUint32(sb, uint32(len(val)))
+	binary.LittleEndian.PutUint32(sb, uint32(valLen))
 	sb = sb[4:]
 
 	sb[0] = byte(wt)
 	sb = sb[1:]
 
-	sb[0] = 0 // reserved. exists just to make header length even.
+	sb[0] = flags
 	sb = sb[1:]
 
 	// Copy key and value
 	copy(sb, key)
 	sb = sb[len(key):]
 
+	if ts != 0 {
+		binary.LittleEndian.PutUint64(sb, uint64(ts))
+		sb = sb[tsLen:]
+	}
+
 	copy(sb, val)
 	sb = sb[len(val):]
 
@@ -70,7 +108,7 @@ func writeRecord(w io.Writer, wt WriteType, key string, val string) (int64, erro
 }
 
 // readRecord reads back a single record at offset in two syscalls:
-//  1. ReadAt 18 bytes → header[0:8]=checksum, header[8:12]=keyLen, header[12:16]=valLen, header[16]=writeType, header[17] reserved
+//  1. ReadAt 18 bytes → header[0:8]=checksum, header[8:12]=keyLen, header[12:16]=valLen, header[16]=writeType, header[17] flags
 //  2. ReadAt keyLen+valLen bytes → payload
 //
 // I'm okay with two syscalls, no need to optimize them
@@ -92,60 +130,165 @@ func readRecord(r io.ReaderAt, off int64, verifyChecksum bool) (string, WriteTyp
 		return "", wt, err
 	}
 
+	return decodePayload(buf, checksum, keyLen, wt, verifyChecksum)
+}
+
+// decodeRecord is readRecord for a segment that's mapped into memory,
+// the record is sliced from b instead of being read from the file.
+func decodeRecord(b []byte, off int64, verifyChecksum bool) (string, WriteType, error) {
+	if off < 0 || int64(len(b))-off < hdrLen {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+
+	checksum, keyLen, valLen, wt := parseHeader([hdrLen]byte(b[off:]))
+
+	totalLen := int64(hdrLen + keyLen + valLen)
+	if int64(len(b))-off < totalLen {
+		return "", wt, io.ErrUnexpectedEOF
+	}
+
+	return decodePayload(b[off:off+totalLen], checksum, keyLen, wt, verifyChecksum)
+}
+
+// decodePayload verifies the checksum of a whole record and returns a copy of its value
+func decodePayload(rec []byte, checksum uint64, keyLen int, wt WriteType, verifyChecksum bool) (string, WriteType, error) {
 	// on checksum problems on single record reads, we just return the error but db continues to operate.
 	if verifyChecksum {
-		if computed := xxh3.Hash(buf[csLen:]); checksum != computed {
+		if computed := xxh3.Hash(rec[csLen:]); checksum != computed {
 			return "", wt, fmt.Errorf("%w: expected %x, got %x", ErrChecksumMismatch, checksum,
 				computed)
 		}
 	}
 
-	val := string(buf[hdrLen+keyLen:])
-	return val, wt, nil
+	val, _, err := splitValue(rec, keyLen)
+	if err != nil {
+		return "", wt, err
+	}
+	return string(val), wt, nil
+}
+
+// splitValue returns the value of a whole record and its write time, which
+// is zero for records written without one
+func splitValue(rec []byte, keyLen int) ([]byte, time.Time, error) {
+	val := rec[hdrLen+keyLen:]
+	if rec[hdrLen-1]&recFlagTimestamp == 0 {
+		return val, time.Time{}, nil
+	}
+
+	if len(val) < tsLen {
+		return nil, time.Time{}, fmt.Errorf("record timestamp: %w", errTruncated)
+	}
+	return val[tsLen:], time.Unix(0, int64(binary.LittleEndian.Uint64(val))), nil
 }
 
 // scannedRecord is used by recordScanner to keep information about current record
 type scannedRecord struct {
-	key string
-	val string
-	off int64 // start offset of the record in the file
-	wt  WriteType
+	key     string
+	off     int64 // start offset of the record in the file
+	valLen  int
+	valSize int // length of the value, valLen without the timestamp
+	wt      WriteType
 }
 
 // recordScanner is a buffered record reader that doesn't touch file handle
+//
+// It can be used in two ways. scan reads whole records and fills record,
+// without keeping the values around. scanHeader reads only the header and the
+// key of the next record and leaves the decision about the value to the caller:
+// readValue reads (and verifies) it, which gives access to the raw record bytes,
+// otherwise it's skipped on the next scanHeader call.
 type recordScanner struct {
 	reader         *bufio.Reader
 	record         *scannedRecord // keeps the current record information
-	end            int64          // keeps the end offset of the current record
+	end            int64          // keeps the end offset of the last consumed record
 	err            error          // keeps error state
 	verifyChecksum bool
+	limit          int64 // records must end before this offset, 0 means no limit
+
+	// state of the record read by scanHeader, valid until the next scan call
+	buf      []byte // raw record bytes, reused between records
+	key      []byte // key bytes, points into buf
+	off      int64  // start offset of the current record
+	wt       WriteType
+	flags    byte
+	checksum uint64
+	valLen   int
+	pending  bool // value of the current record is not consumed yet
 }
 
 func newRecordScanner(r io.ReaderAt, verifyChecksum bool) *recordScanner {
+	return newRecordScannerAt(r, 0, verifyChecksum)
+}
+
+// newRecordScannerAt creates a scanner that starts at offset off,
+// which must be the start of a record.
+func newRecordScannerAt(r io.ReaderAt, off int64, verifyChecksum bool) *recordScanner {
 	const maxint64 = 1<<63 - 1 // maybe check file size instead
 
 	// we're using SectionReader so we don't touch the file handle
 	// this way we run scan the file repeatedly
-	sr := io.NewSectionReader(r, 0, maxint64)
-	return &recordScanner{reader: bufio.NewReader(sr), verifyChecksum: verifyChecksum}
+	sr := io.NewSectionReader(r, off, maxint64-off)
+	return &recordScanner{reader: bufio.NewReader(sr), end: off, verifyChecksum: verifyChecksum}
+}
+
+// newRecordScannerRange creates a scanner for the records in [off, end). Unlike
+// the other scanners, a record that doesn't fit in the range is an error, so
+// it's meant for segments whose size is known.
+func newRecordScannerRange(r io.ReaderAt, off, end int64, verifyChecksum bool) *recordScanner {
+	// nothing is read past end, reaching it is a clean stop
+	sr := io.NewSectionReader(r, off, end-off)
+	return &recordScanner{reader: bufio.NewReader(sr), end: off, limit: end, verifyChecksum: verifyChecksum}
+}
+
+// isEOF reports whether err means we ran out of data, either
+// on a record boundary or in the middle of a record
+func isEOF(err error) bool {
+	return err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)
 }
 
+// scan reads the next record and fills rs.record. The value is only read
+// when checksum verification is enabled, and it's not kept in any case.
 func (rs *recordScanner) scan() bool {
-	// we stop processing further after an error
-	if rs.err != nil {
+	// resetting the record
+	rs.record = nil
+
+	if !rs.scanHeader() {
 		return false
 	}
 
-	reader := rs.reader
+	if rs.verifyChecksum {
+		if !rs.readValue() {
+			return false
+		}
+	} else if !rs.skipValue() {
+		return false
+	}
 
-	// resetting the record
-	rs.record = nil
+	rs.record = &scannedRecord{
+		key:     string(rs.key),
+		off:     rs.off,
+		valLen:  rs.valLen,
+		valSize: rs.valSize(),
+		wt:      rs.wt,
+	}
+
+	return true
+}
 
-	// Either EOF
-	isEOF := func(err error) bool {
-		return err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)
+// scanHeader reads the header and the key of the next record into rs.key, rs.wt
+// and rs.off. If the value of the previous record wasn't read, it's skipped.
+func (rs *recordScanner) scanHeader() bool {
+	// we stop processing further after an error
+	if rs.err != nil {
+		return false
 	}
 
+	if rs.pending && !rs.skipValue() {
+		return false
+	}
+
+	reader := rs.reader
+
 	var hdr [hdrLen]byte
 
 	// read the header
@@ -162,17 +305,67 @@ func (rs *recordScanner) scan() bool {
 	checksum, keyLen, valLen, wt := parseHeader(hdr)
 
 	totalLen := hdrLen + keyLen + valLen
-	buf := make([]byte, totalLen)
-	copy(buf, hdr[:]) // buf[:hdrLen] filled
+	if rs.limit > 0 && rs.end+int64(totalLen) > rs.limit {
+		rs.err = fmt.Errorf("%w: record at %d has length %d", errRecordOutOfRange, rs.end, totalLen)
+		return false
+	}
 
-	// Read key+val into the remaining part
-	if _, err := io.ReadFull(reader, buf[hdrLen:]); err != nil {
+	if cap(rs.buf) < totalLen {
+		rs.buf = make([]byte, totalLen)
+	}
+	rs.buf = rs.buf[:totalLen]
+	copy(rs.buf, hdr[:]) // buf[:hdrLen] filled
+
+	// Read the key, value is read later on demand
+	if _, err := io.ReadFull(reader, rs.buf[hdrLen:hdrLen+keyLen]); err != nil {
+		if !isEOF(err) {
+			rs.err = fmt.Errorf("read key: %w", err)
+		}
+
+		// EOF here means partially written key i.e. corruption
+		// we bail out here, we're just ignoring the partially written key
+		return false
+	}
+
+	rs.key = rs.buf[hdrLen : hdrLen+keyLen]
+	rs.off = rs.end
+	rs.wt = wt
+	rs.flags = hdr[hdrLen-1]
+	rs.checksum = checksum
+	rs.valLen = valLen
+	rs.pending = true
+
+	return true
+}
+
+// skipValue discards the value of the current record without reading it.
+// Checksum can't be verified in this case.
+func (rs *recordScanner) skipValue() bool {
+	if _, err := rs.reader.Discard(rs.valLen); err != nil {
+		if !isEOF(err) {
+			rs.err = fmt.Errorf("skip value: %w", err)
+		}
+
+		// EOF here means partially written value i.e. corruption
+		// we bail out here, we're just ignoring the partially written value
+		return false
+	}
+
+	rs.consume()
+	return true
+}
+
+// readValue reads the value of the current record and verifies
+// the checksum of the record if it's enabled.
+func (rs *recordScanner) readValue() bool {
+	keyLen := len(rs.key)
+	if _, err := io.ReadFull(rs.reader, rs.buf[hdrLen+keyLen:]); err != nil {
 		if !isEOF(err) {
-			rs.err = fmt.Errorf("read key+value: %w", err)
+			rs.err = fmt.Errorf("read value: %w", err)
 		}
 
-		// EOF here means partially written key/value i.e. corruption
-		// we bail out here, we're just ignoring the partially written key/value
+		// EOF here means partially written value i.e. corruption
+		// we bail out here, we're just ignoring the partially written value
 		return false
 	}
 
@@ -182,42 +375,38 @@ func (rs *recordScanner) scan() bool {
 	// But partial records on tail only mean db closed for some reason(power loss) and client
 	// didn't get any acknowledgement. Therefore, we can choose to ignore them.
 	if rs.verifyChecksum {
-		if computed := xxh3.Hash(buf[csLen:]); checksum != computed {
-			rs.err = fmt.Errorf("%w: expected %x, got %x", ErrChecksumMismatch, checksum,
+		if computed := xxh3.Hash(rs.buf[csLen:]); rs.checksum != computed {
+			rs.err = fmt.Errorf("%w: expected %x, got %x", ErrChecksumMismatch, rs.checksum,
 				computed)
 			return false
 		}
 	}
 
-	rs.record = &scannedRecord{
-		key: string(buf[hdrLen : hdrLen+keyLen]),
-		val: string(buf[hdrLen+keyLen:]),
-		off: rs.end,
-		wt:  wt,
-	}
-
-	// todo consider making this function configurable so that
-	//  it may skip values when only keys are needed.
-	//  the best approach may be to give a read/skip choice for
-	//  each key separately, because on segment merge we decide
-	//  per key to read the value!
-	//// skip value payload because we don't need it on the index
-	//if _, err := io.CopyN(io.Discard, reader, int64(valLen)); err != nil {
-	//	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
-	//		break
-	//	}
-	//
-	//	// EOF here means partially written value i.e. corruption
-	//	// we bail out here, we're just ignoring the partially written value
-	//	return 0, err
-	//}
-
-	// advance offset for next record
-	rs.end += int64(hdrLen + keyLen + valLen)
-
+	rs.consume()
 	return true
 }
 
+// valSize returns the length of the value of the current record, without
+// the timestamp. It's the valSize of the record's location in the index.
+func (rs *recordScanner) valSize() int {
+	if rs.flags&recFlagTimestamp != 0 {
+		return max(rs.valLen-tsLen, 0)
+	}
+	return rs.valLen
+}
+
+// raw returns the complete encoded bytes of the current record, including its
+// checksum. Only valid after readValue and until the next scan call.
+func (rs *recordScanner) raw() []byte {
+	return rs.buf
+}
+
+// consume marks the current record as fully read and advances the offset
+func (rs *recordScanner) consume() {
+	rs.pending = false
+	rs.end = rs.off + int64(hdrLen+len(rs.key)+rs.valLen)
+}
+
 func parseHeader(hdr [hdrLen]byte) (uint64, int, int, WriteType) {
 	sb := hdr[:] // shrinking buffer
 
@@ -233,7 +422,7 @@ func parseHeader(hdr [hdrLen]byte) (uint64, int, int, WriteType) {
 	wt := WriteType(sb[0])
 	sb = sb[1:]
 
-	_ = sb[0] // reserved byte
+	_ = sb[0] // flags, see splitValue
 	sb = sb[1:]
 
 	if len(sb) != 0 {
@@ -242,3 +431,44 @@ func parseHeader(hdr [hdrLen]byte) (uint64, int, int, WriteType) {
 
 	return checksum, keyLen, valLen, wt
 }
+
+var errTruncated = errors.New("truncated data")
+
+var errRecordOutOfRange = errors.New("record runs past the end of the segment")
+
+// byteReader decodes varint encoded metadata like the checkpoint
+// and the manifest, it keeps the first error
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *byteReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if uint64(len(r.buf)) < n {
+		r.err = errTruncated
+		return nil
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
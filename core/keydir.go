@@ -0,0 +1,109 @@
+package core
+
+// recordLocation keeps the address of a record in the multi-segment data layout.
+// There's one for every key, so it's kept small and free of pointers, which
+// also means the garbage collector doesn't need to scan the index.
+type recordLocation struct {
+	segId   uint32 // id of the segment holding the record
+	valSize uint32 // length of the value in bytes, without the record timestamp
+	offset  int64  // start offset of the record in the segment
+}
+
+// at reports whether the location points to the record at offset off of seg
+func (loc recordLocation) at(seg *segment, off int64) bool {
+	return loc.segId == uint32(seg.id) && loc.offset == off
+}
+
+// keydir maps each key to the location of a record. The default one keeps
+// everything in memory, diskKeydir keeps the entries in files and only
+// caches some of them in memory.
+//
+// keydir is not safe for concurrent modification, callers are expected to
+// hold the db lock. Concurrent reads are fine.
+type keydir interface {
+	get(key string) (recordLocation, bool)
+	// getBytes is the same as get, but it avoids allocating a string for the key
+	getBytes(key []byte) (recordLocation, bool)
+	put(key string, loc recordLocation)
+	delete(key string)
+	len() int
+	// forEach calls fn for each entry until fn returns false.
+	// keydir must not be modified during the iteration.
+	forEach(fn func(key string, loc recordLocation) bool)
+	// memoryUsage returns the estimated number of bytes held in memory
+	memoryUsage() int64
+	// diskUsage returns the number of bytes held in files
+	diskUsage() int64
+	// err returns the first error an operation ran into. The keydir can't
+	// be trusted after that, lookups find nothing and updates are dropped.
+	err() error
+	close() error
+}
+
+// keydirEntryOverhead is the estimated memory cost of a keydir entry besides
+// the key bytes: string header and location (16+16 bytes) in a map slot, plus
+// the control byte and the empty slots kept around by the map's load factor.
+const keydirEntryOverhead = 40
+
+// memKeydir is a keydir backed by a map. It keeps track of
+// the key bytes it holds, so its memory usage can be reported cheaply.
+type memKeydir struct {
+	m        map[string]recordLocation
+	keyBytes int64
+}
+
+func newMemKeydir() *memKeydir {
+	return &memKeydir{m: make(map[string]recordLocation)}
+}
+
+func (kd *memKeydir) get(key string) (recordLocation, bool) {
+	loc, ok := kd.m[key]
+	return loc, ok
+}
+
+func (kd *memKeydir) getBytes(key []byte) (recordLocation, bool) {
+	loc, ok := kd.m[string(key)]
+	return loc, ok
+}
+
+func (kd *memKeydir) put(key string, loc recordLocation) {
+	if _, ok := kd.m[key]; !ok {
+		kd.keyBytes += int64(len(key))
+	}
+	kd.m[key] = loc
+}
+
+func (kd *memKeydir) delete(key string) {
+	if _, ok := kd.m[key]; ok {
+		kd.keyBytes -= int64(len(key))
+		delete(kd.m, key)
+	}
+}
+
+func (kd *memKeydir) len() int {
+	return len(kd.m)
+}
+
+func (kd *memKeydir) forEach(fn func(key string, loc recordLocation) bool) {
+	for key, loc := range kd.m {
+		if !fn(key, loc) {
+			return
+		}
+	}
+}
+
+func (kd *memKeydir) memoryUsage() int64 {
+	return kd.keyBytes + int64(len(kd.m))*keydirEntryOverhead
+}
+
+func (kd *memKeydir) diskUsage() int64 {
+	return 0
+}
+
+func (kd *memKeydir) err() error {
+	return nil
+}
+
+func (kd *memKeydir) close() error {
+	return nil
+}
@@ -0,0 +1,490 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/zeebo/xxh3"
+)
+
+// The disk index keeps the keydir out of the Go heap, for datasets whose keys
+// don't fit in memory. Each keydir is an open addressing hash table in a
+// memory mapped file, so the OS decides which pages stay in memory. Keys have
+// variable length, they are appended to a separate key file and the table
+// slots point to them. A bounded LRU cache in front of the table keeps the
+// locations of recently used keys.
+//
+// The files are scratch space, they are rebuilt from the segments (or the
+// checkpoint) on every Open and removed on Close. Segment format is unchanged.
+//
+// Slot layout (little endian, 40 bytes):
+//
+//	[8-byte key hash][8-byte key offset][8-byte record offset]
+//	[4-byte key length][4-byte segment id][4-byte value size][4-byte state]
+const keydirDirName = "keydir"
+
+const (
+	diskSlotSize     = 40
+	diskInitialSlots = 1024
+	diskMaxLoad      = 0.7 // grow when used+deleted slots exceed this fraction
+
+	// the key file is compacted when most of it is keys that were deleted
+	diskMinKeysCompact = 64 * 1024
+)
+
+// slot states. deleted slots keep the probe chains intact until the next rehash
+const (
+	slotEmpty uint32 = iota
+	slotUsed
+	slotDeleted
+)
+
+// WithDiskIndex keeps the index in memory mapped files under the data directory
+// instead of the Go heap. Only cacheBytes worth of recently used entries are
+// kept in memory, the rest is paged in by the OS on demand. It's useful when the
+// keys don't fit in memory, at the cost of slower lookups and writes.
+//
+// Failing to read or write the index files fails the Get, Set or Delete that
+// ran into it, and every one after it until the database is reopened, which
+// rebuilds the index.
+func WithDiskIndex(cacheBytes int64) Option {
+	return func(db *DB) {
+		db.diskIndex = true
+		db.indexCacheBytes = cacheBytes
+	}
+}
+
+// newKeydir creates an empty keydir according to the options
+func (db *DB) newKeydir(name string) (keydir, error) {
+	if !db.diskIndex {
+		return newMemKeydir(), nil
+	}
+
+	kd, err := newDiskKeydir(filepath.Join(db.dir, keydirDirName), name, db.indexCacheBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return kd, nil
+}
+
+// resetKeydirDir removes the leftovers of the previous disk index, if any
+func resetKeydirDir(dir string) error {
+	path := filepath.Join(dir, keydirDirName)
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("remove %q: %w", path, err)
+	}
+
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return fmt.Errorf("mkdir %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// diskKeydir is a keydir stored in a memory mapped hash table.
+// Deleted keys leave their bytes in the key file until it's compacted.
+type diskKeydir struct {
+	tablePath string
+	table     *os.File
+	slots     []byte // mapped table file
+	mask      uint64 // slot count - 1, slot count is a power of two
+	used      int
+	deleted   int
+
+	keys     *os.File // append-only key bytes
+	keysPath string
+	keysEnd  int64
+	liveKeys int64 // bytes of the keys in used slots
+
+	cache *lru[string, recordLocation]
+
+	failed atomic.Pointer[error] // first I/O error, see keydir.err. gets set it under the read lock too
+}
+
+func newDiskKeydir(dir, name string, cacheBytes int64) (*diskKeydir, error) {
+	kd := &diskKeydir{
+		tablePath: filepath.Join(dir, name+".table"),
+		keysPath:  filepath.Join(dir, name+".keys"),
+		cache:     newLRU[string, recordLocation](cacheBytes),
+	}
+
+	keys, err := os.OpenFile(kd.keysPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create key file: %w", err)
+	}
+	kd.keys = keys
+
+	table, slots, err := createDiskTable(kd.tablePath, diskInitialSlots)
+	if err != nil {
+		_ = keys.Close()
+		return nil, err
+	}
+	kd.table, kd.slots, kd.mask = table, slots, diskInitialSlots-1
+
+	return kd, nil
+}
+
+// createDiskTable creates a table file with n empty slots and maps it
+func createDiskTable(path string, n int) (*os.File, []byte, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create table file: %w", err)
+	}
+
+	// a sparse file reads as zeros, which are empty slots
+	if err := f.Truncate(int64(n) * diskSlotSize); err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("truncate table file: %w", err)
+	}
+
+	slots, err := mmapFile(f, n*diskSlotSize, true)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("mmap table file: %w", err)
+	}
+
+	return f, slots, nil
+}
+
+// diskSlot is a decoded table slot
+type diskSlot struct {
+	hash   uint64
+	keyOff int64
+	keyLen uint32
+	loc    recordLocation
+	state  uint32
+}
+
+func decodeSlot(b []byte) diskSlot {
+	return diskSlot{
+		hash:   binary.LittleEndian.Uint64(b[0:]),
+		keyOff: int64(binary.LittleEndian.Uint64(b[8:])),
+		keyLen: binary.LittleEndian.Uint32(b[24:]),
+		loc: recordLocation{
+			segId:   binary.LittleEndian.Uint32(b[28:]),
+			valSize: binary.LittleEndian.Uint32(b[32:]),
+			offset:  int64(binary.LittleEndian.Uint64(b[16:])),
+		},
+		state: binary.LittleEndian.Uint32(b[36:]),
+	}
+}
+
+func encodeSlot(b []byte, s diskSlot) {
+	binary.LittleEndian.PutUint64(b[0:], s.hash)
+	binary.LittleEndian.PutUint64(b[8:], uint64(s.keyOff))
+	binary.LittleEndian.PutUint64(b[16:], uint64(s.loc.offset))
+	binary.LittleEndian.PutUint32(b[24:], s.keyLen)
+	binary.LittleEndian.PutUint32(b[28:], s.loc.segId)
+	binary.LittleEndian.PutUint32(b[32:], s.loc.valSize)
+	binary.LittleEndian.PutUint32(b[36:], s.state)
+}
+
+func (kd *diskKeydir) slot(i uint64) []byte {
+	return kd.slots[i*diskSlotSize : (i+1)*diskSlotSize]
+}
+
+// fail records the first error, the keydir is unusable after it
+func (kd *diskKeydir) fail(err error) {
+	err = fmt.Errorf("disk index: %w", err)
+	kd.failed.CompareAndSwap(nil, &err)
+}
+
+func (kd *diskKeydir) err() error {
+	if err := kd.failed.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// readKey reads the key of a used slot from the key file
+func (kd *diskKeydir) readKey(s diskSlot) (string, bool) {
+	buf := make([]byte, s.keyLen)
+	if _, err := kd.keys.ReadAt(buf, s.keyOff); err != nil {
+		kd.fail(fmt.Errorf("read key at %d: %w", s.keyOff, err))
+		return "", false
+	}
+	return string(buf), true
+}
+
+// find looks up key in the table. If it's not found, the returned
+// index is the slot where it should be inserted.
+func (kd *diskKeydir) find(key string, h uint64) (uint64, diskSlot, bool) {
+	// first deleted slot on the probe chain, which can be reused for key
+	insertAt, haveInsert := uint64(0), false
+
+	for i := h & kd.mask; ; i = (i + 1) & kd.mask {
+		s := decodeSlot(kd.slot(i))
+		switch s.state {
+		case slotEmpty:
+			if !haveInsert {
+				return i, s, false
+			}
+			return insertAt, decodeSlot(kd.slot(insertAt)), false
+		case slotDeleted:
+			if !haveInsert {
+				insertAt, haveInsert = i, true
+			}
+		case slotUsed:
+			if s.hash != h || int(s.keyLen) != len(key) {
+				continue
+			}
+			k, ok := kd.readKey(s)
+			if !ok {
+				return i, s, false
+			}
+			if k == key {
+				return i, s, true
+			}
+		}
+	}
+}
+
+func (kd *diskKeydir) get(key string) (recordLocation, bool) {
+	if kd.err() != nil {
+		return recordLocation{}, false
+	}
+
+	if loc, ok := kd.cache.get(key); ok {
+		return loc, true
+	}
+
+	_, s, ok := kd.find(key, xxh3.HashString(key))
+	if !ok || kd.err() != nil {
+		return recordLocation{}, false
+	}
+
+	kd.cache.add(key, s.loc, int64(len(key))+lruEntryOverhead)
+	return s.loc, true
+}
+
+// getBytes bypasses the cache, it's used by merge which
+// goes over every key and would only pollute it.
+func (kd *diskKeydir) getBytes(key []byte) (recordLocation, bool) {
+	if kd.err() != nil {
+		return recordLocation{}, false
+	}
+
+	_, s, ok := kd.find(string(key), xxh3.Hash(key))
+	if !ok || kd.err() != nil {
+		return recordLocation{}, false
+	}
+	return s.loc, true
+}
+
+func (kd *diskKeydir) put(key string, loc recordLocation) {
+	if kd.err() != nil {
+		return
+	}
+
+	h := xxh3.HashString(key)
+	i, s, ok := kd.find(key, h)
+	if kd.err() != nil {
+		return
+	}
+
+	if !ok {
+		if float64(kd.used+kd.deleted+1) > diskMaxLoad*float64(len(kd.slots)/diskSlotSize) {
+			if err := kd.rehash(); err != nil {
+				kd.fail(err)
+				return
+			}
+			i, s, _ = kd.find(key, h)
+		}
+
+		if kd.keysEnd > diskMinKeysCompact && kd.keysEnd > 2*kd.liveKeys {
+			if err := kd.compactKeys(); err != nil {
+				kd.fail(err)
+				return
+			}
+		}
+
+		off, err := kd.appendKey(key)
+		if err != nil {
+			kd.fail(err)
+			return
+		}
+
+		if s.state == slotDeleted {
+			kd.deleted--
+		}
+		kd.used++
+		kd.liveKeys += int64(len(key))
+
+		s = diskSlot{hash: h, keyOff: off, keyLen: uint32(len(key)), state: slotUsed}
+	}
+
+	s.loc = loc
+	encodeSlot(kd.slot(i), s)
+	kd.cache.add(key, loc, int64(len(key))+lruEntryOverhead)
+}
+
+// appendKey writes key to the end of the key file and returns its offset
+func (kd *diskKeydir) appendKey(key string) (int64, error) {
+	off := kd.keysEnd
+	if _, err := kd.keys.WriteAt([]byte(key), off); err != nil {
+		return 0, fmt.Errorf("write key at %d: %w", off, err)
+	}
+	kd.keysEnd += int64(len(key))
+	return off, nil
+}
+
+func (kd *diskKeydir) delete(key string) {
+	kd.cache.remove(key)
+	if kd.err() != nil {
+		return
+	}
+
+	i, s, ok := kd.find(key, xxh3.HashString(key))
+	if !ok {
+		return
+	}
+
+	s.state = slotDeleted
+	encodeSlot(kd.slot(i), s)
+	kd.used--
+	kd.deleted++
+	kd.liveKeys -= int64(s.keyLen)
+}
+
+// compactKeys rewrites the key file with only the keys of used slots
+func (kd *diskKeydir) compactKeys() (rerr error) {
+	tmpPath := kd.keysPath + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("create key file: %w", err)
+	}
+	defer func() {
+		if rerr != nil {
+			_ = f.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	// slots are only updated once the new file is in place
+	offs := make(map[uint64]int64, kd.used)
+	var end int64
+	for i := uint64(0); i <= kd.mask; i++ {
+		s := decodeSlot(kd.slot(i))
+		if s.state != slotUsed {
+			continue
+		}
+
+		key, ok := kd.readKey(s)
+		if !ok {
+			return kd.err()
+		}
+		if _, err := f.WriteAt([]byte(key), end); err != nil {
+			return fmt.Errorf("write key at %d: %w", end, err)
+		}
+		offs[i] = end
+		end += int64(len(key))
+	}
+
+	if err := os.Rename(tmpPath, kd.keysPath); err != nil {
+		return fmt.Errorf("replace key file: %w", err)
+	}
+	_ = kd.keys.Close()
+	kd.keys, kd.keysEnd = f, end
+
+	for i, off := range offs {
+		b := kd.slot(i)
+		binary.LittleEndian.PutUint64(b[8:], uint64(off))
+	}
+
+	return nil
+}
+
+// rehash moves the used slots to a new table, doubling it if needed.
+// It also clears the deleted slots.
+func (kd *diskKeydir) rehash() error {
+	n := len(kd.slots) / diskSlotSize
+	for float64(kd.used+1) > diskMaxLoad/2*float64(n) {
+		n *= 2
+	}
+
+	tmpPath := kd.tablePath + ".tmp"
+	table, slots, err := createDiskTable(tmpPath, n)
+	if err != nil {
+		return fmt.Errorf("grow table: %w", err)
+	}
+
+	mask := uint64(n - 1)
+	for i := uint64(0); i <= kd.mask; i++ {
+		old := kd.slot(i)
+		if decodeSlot(old).state != slotUsed {
+			continue
+		}
+
+		// stored hashes spare us reading the keys back
+		j := binary.LittleEndian.Uint64(old) & mask
+		for binary.LittleEndian.Uint32(slots[j*diskSlotSize+36:]) != slotEmpty {
+			j = (j + 1) & mask
+		}
+		copy(slots[j*diskSlotSize:], old)
+	}
+
+	// the new table is used even if the old one can't be released
+	closeErr := kd.closeTable()
+	kd.table, kd.slots, kd.mask, kd.deleted = table, slots, mask, 0
+	if closeErr != nil {
+		return fmt.Errorf("close old table: %w", closeErr)
+	}
+
+	if err := os.Rename(tmpPath, kd.tablePath); err != nil {
+		return fmt.Errorf("replace table: %w", err)
+	}
+
+	return nil
+}
+
+func (kd *diskKeydir) len() int {
+	return kd.used
+}
+
+func (kd *diskKeydir) forEach(fn func(key string, loc recordLocation) bool) {
+	for i := uint64(0); i <= kd.mask; i++ {
+		s := decodeSlot(kd.slot(i))
+		if s.state != slotUsed {
+			continue
+		}
+		key, ok := kd.readKey(s)
+		if !ok || !fn(key, s.loc) {
+			return
+		}
+	}
+}
+
+// memoryUsage only counts the cache. mapped pages
+// belong to the page cache and can be evicted.
+func (kd *diskKeydir) memoryUsage() int64 {
+	_, used := kd.cache.stats()
+	return used
+}
+
+func (kd *diskKeydir) diskUsage() int64 {
+	return int64(len(kd.slots)) + kd.keysEnd
+}
+
+func (kd *diskKeydir) closeTable() error {
+	return errors.Join(munmap(kd.slots), kd.table.Close())
+}
+
+// close releases the files and removes them, they're rebuilt on Open
+func (kd *diskKeydir) close() error {
+	errs := errors.Join(kd.closeTable(), kd.keys.Close())
+	kd.slots = nil
+
+	for _, path := range []string{kd.tablePath, kd.keysPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestDiskKeydirMatchesMemKeydir runs the same random operations on both
+// keydirs, enough of them to grow the disk table a few times.
+func TestDiskKeydirMatchesMemKeydir(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := newDiskKeydir(dir, "test", 50*lruEntryOverhead)
+	if err != nil {
+		t.Fatalf("new disk keydir: %v", err)
+	}
+	mem := newMemKeydir()
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key-%d", rng.Intn(5000))
+		if rng.Intn(4) == 0 {
+			disk.delete(key)
+			mem.delete(key)
+			continue
+		}
+
+		loc := recordLocation{segId: uint32(rng.Intn(10)), valSize: uint32(i), offset: int64(i)}
+		disk.put(key, loc)
+		mem.put(key, loc)
+	}
+
+	if disk.len() != mem.len() {
+		t.Fatalf("expected %d keys, got %d", mem.len(), disk.len())
+	}
+	if disk.mask+1 <= diskInitialSlots {
+		t.Fatalf("expected the table to grow, it has %d slots", disk.mask+1)
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want, wantOk := mem.get(key)
+		got, ok := disk.get(key)
+		gotBytes, okBytes := disk.getBytes([]byte(key))
+		if ok != wantOk || got != want || okBytes != wantOk || gotBytes != want {
+			t.Fatalf("%s: expected %+v %v, got %+v %v and %+v %v", key, want, wantOk, got, ok, gotBytes, okBytes)
+		}
+	}
+
+	seen := 0
+	disk.forEach(func(key string, loc recordLocation) bool {
+		if want, ok := mem.get(key); !ok || want != loc {
+			t.Fatalf("forEach: unexpected %s=%+v", key, loc)
+		}
+		seen++
+		return true
+	})
+	if seen != mem.len() {
+		t.Fatalf("forEach visited %d keys, expected %d", seen, mem.len())
+	}
+
+	if n, _ := disk.cache.stats(); n > 50 {
+		t.Fatalf("cache holds %d entries, above its budget", n)
+	}
+
+	if err := disk.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected the index files to be removed, found %d", len(entries))
+	}
+}
+
+// TestDiskKeydirCompactsKeys churns through keys that are deleted right away,
+// the key file must stay bounded by the live keys
+func TestDiskKeydirCompactsKeys(t *testing.T) {
+	disk, err := newDiskKeydir(t.TempDir(), "test", 0)
+	if err != nil {
+		t.Fatalf("new disk keydir: %v", err)
+	}
+	defer disk.close() // nolint:errcheck
+
+	disk.put("stay", recordLocation{segId: 1, offset: 7})
+	for i := range 20000 {
+		key := fmt.Sprintf("churn-%d", i)
+		disk.put(key, recordLocation{})
+		disk.delete(key)
+	}
+
+	if err := disk.err(); err != nil {
+		t.Fatalf("disk keydir failed: %v", err)
+	}
+	if disk.keysEnd > 2*diskMinKeysCompact {
+		t.Fatalf("expected the key file to be compacted, it has %d bytes", disk.keysEnd)
+	}
+	if loc, ok := disk.getBytes([]byte("stay")); !ok || loc.offset != 7 {
+		t.Fatalf("expected stay to survive compactions, got %+v, %v", loc, ok)
+	}
+}
+
+// TestDiskIndexErrors makes the key file unusable, operations that need it
+// must fail instead of panicking
+func TestDiskIndexErrors(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithDiskIndex(0))
+	_ = db.Set("a", "1")
+
+	_ = db.index.(*diskKeydir).keys.Close()
+
+	if err := db.Set("b", "2"); err == nil {
+		t.Fatalf("expected set to fail")
+	}
+	if _, err := db.Get("a"); err == nil || errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected get to fail with the index error, got %v", err)
+	}
+	if err := db.Delete("a"); err == nil || errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected delete to fail with the index error, got %v", err)
+	}
+}
+
+// TestDiskIndexConcurrentErrors fails gets that run together, run it with -race
+func TestDiskIndexConcurrentErrors(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithDiskIndex(0))
+	for i := range 8 {
+		_ = db.Set(fmt.Sprint("k", i), "1")
+	}
+
+	_ = db.index.(*diskKeydir).keys.Close()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Get(fmt.Sprint("k", i)); err == nil || errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected get to fail with the index error, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDiskIndexReopen(t *testing.T) {
+	for _, checkpoint := range []bool{false, true} {
+		t.Run(fmt.Sprintf("checkpoint=%v", checkpoint), func(t *testing.T) {
+			opts := []Option{
+				WithRolloverThreshold(100), WithMergeEnabled(false),
+				WithCheckpoint(checkpoint), WithDiskIndex(1024),
+			}
+			db, dir, _ := SetupTempDB(t, opts...)
+
+			fillCheckpointDB(t, db)
+			checkCheckpointDB(t, db)
+
+			st := db.Stats()
+			if st.Keys != 16 || st.Tombstones != 4 || st.IndexDiskBytes == 0 || st.IndexBytes > 2048 {
+				t.Fatalf("unexpected stats: %+v", st)
+			}
+			_ = db.Close()
+
+			if _, err := os.Stat(filepath.Join(dir, keydirDirName, "index.table")); !os.IsNotExist(err) {
+				t.Fatalf("expected index files to be removed on Close, got %v", err)
+			}
+
+			db2, err := Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer db2.Close() // nolint:errcheck
+
+			checkCheckpointDB(t, db2)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// WithLoadWorkers sets how many segments are scanned in parallel on Open.
+func WithLoadWorkers(n int) Option {
+	return func(db *DB) { db.loadWorkers = max(n, 1) }
+}
+
+// WithLoadProgress registers a callback that's called on Open each time a
+// segment is loaded into the index, with the number of loaded segments so far
+// and the total number of segments.
+func WithLoadProgress(f func(loaded, total int)) Option {
+	return func(db *DB) { db.onLoadProgress = f }
+}
+
+// loadResult is the outcome of scanning a single segment on Open
+type loadResult struct {
+	seg  *segment
+	recs []*scannedRecord
+	err  error
+}
+
+// loadSegments scans the segments with a pool of workers and applies them to
+// the index one by one in the given (manifest) order. Since the index replays
+// the history, results are never applied out of order, segments that are
+// scanned early wait for their predecessors.
+func (db *DB) loadSegments(segIds []int) (rerr error) {
+	total := len(segIds)
+	workers := min(db.loadWorkers, total)
+
+	// one channel per segment so results can be picked up in order
+	results := make([]chan loadResult, total)
+	for i := range results {
+		results[i] = make(chan loadResult, 1)
+	}
+
+	// window limits how far workers can get ahead of the applier,
+	// which bounds the memory held by scanned but not applied records
+	window := make(chan struct{}, 2*workers)
+	quit := make(chan struct{})
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				seg, recs, err := parseSegment(db.dir, segIds[i], db.checksumEnabled, db.skipCorrupted)
+				results[i] <- loadResult{seg: seg, recs: recs, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := range segIds {
+			select {
+			case window <- struct{}{}:
+			case <-quit:
+				return
+			}
+
+			select {
+			case jobs <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	// on error, stop the workers and close the segments
+	// that are scanned but won't be applied
+	defer func() {
+		if rerr == nil {
+			return
+		}
+
+		close(quit)
+		wg.Wait()
+
+		for _, ch := range results {
+			select {
+			case res := <-ch:
+				if res.seg == nil {
+					continue
+				}
+				if err := res.seg.close(); err != nil {
+					log.Printf("close segment %d: %v", res.seg.id, err)
+				}
+			default:
+			}
+		}
+	}()
+
+	for i, id := range segIds {
+		res := <-results[i]
+		<-window
+
+		if res.err != nil {
+			return fmt.Errorf("load segment %d: %w", id, res.err)
+		}
+
+		db.applyRecords(res.seg, res.recs)
+		db.addSegment(res.seg)
+		db.corruptions = append(db.corruptions, res.seg.lost...)
+
+		if db.onLoadProgress != nil {
+			db.onLoadProgress(i+1, total)
+		}
+	}
+
+	return nil
+}
+
+// applyRecords updates db index with the records of a loaded segment
+func (db *DB) applyRecords(seg *segment, recs []*scannedRecord) {
+	replayRecords(seg.id, recs, db.index, db.tombstones)
+}
+
+// replayRecords applies the records of segment id to the index and the tombstones
+func replayRecords(id int, recs []*scannedRecord, index, tombstones keydir) {
+	// We simulate the history. Sets update the index, deletes remove from the index.
+	// We also remember the last tombstone of each deleted key, merge needs it.
+	for _, rec := range recs {
+		loc := recordLocation{segId: uint32(id), valSize: uint32(rec.valSize), offset: rec.off}
+		switch rec.wt {
+		case TypeDelete:
+			index.delete(rec.key)
+			tombstones.put(rec.key, loc)
+		case TypeSet:
+			index.put(rec.key, loc)
+			tombstones.delete(rec.key)
+		default:
+			log.Panicf("unhandled write type: %v", rec.wt)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package core
+
+import "errors"
+
+// loadBatchSize is the number of keys a loader writes per lock
+const loadBatchSize = 1024
+
+// loader is the fast path of imports. It writes keys in batches, taking the
+// lock once per batch, and doesn't fsync them one by one, finish syncs them
+// all at once. Keys added to a loader aren't durable until finish returns.
+type loader struct {
+	db      *DB
+	batch   [][2]string
+	written int // keys written to the segments
+}
+
+func (db *DB) newLoader() *loader {
+	return &loader{db: db, batch: make([][2]string, 0, loadBatchSize)}
+}
+
+func (l *loader) add(key, val string) error {
+	l.batch = append(l.batch, [2]string{key, val})
+	if len(l.batch) < loadBatchSize {
+		return nil
+	}
+	return l.flush()
+}
+
+// flush writes the batch, the keys after a failed one are dropped
+func (l *loader) flush() error {
+	l.db.rw.Lock()
+	defer l.db.rw.Unlock()
+
+	defer func() { l.batch = l.batch[:0] }()
+	for _, kv := range l.batch {
+		if err := l.db.set(kv[0], kv[1], false); err != nil {
+			return err
+		}
+		l.written++
+	}
+
+	return nil
+}
+
+// finish writes the last batch and makes the written keys durable, it
+// syncs them even if the batch fails. It must be called after an error too.
+func (l *loader) finish() error {
+	err := l.flush()
+
+	l.db.rw.Lock()
+	defer l.db.rw.Unlock()
+
+	return errors.Join(err, l.db.syncSegments())
+}
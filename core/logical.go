@@ -0,0 +1,185 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextFormat is a format of ExportText and ImportText
+type TextFormat string
+
+const (
+	// FormatJSONL is one {"key": ..., "value": ...} object per line
+	FormatJSONL TextFormat = "jsonl"
+	// FormatCSV is a key,value header followed by one key,value row per key
+	FormatCSV TextFormat = "csv"
+)
+
+// TextOptions configures ExportText and ImportText
+type TextOptions struct {
+	Format TextFormat
+	// Base64 encodes keys and values with standard base64, for binary data.
+	// Without it, ExportText fails on keys and values that aren't valid
+	// UTF-8 text, or that contain \r in CSV, as they wouldn't round trip.
+	Base64 bool
+}
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+var errNotText = errors.New("not representable as text, use base64")
+
+var csvHeader = []string{"key", "value"}
+
+type textRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ExportText writes the live keys to w in key order, as of when it was called
+func (db *DB) ExportText(w io.Writer, opts TextOptions) error {
+	bw := bufio.NewWriter(w)
+
+	var write func(key, val string) error
+	flush := bw.Flush
+	switch opts.Format {
+	case FormatJSONL:
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		write = func(key, val string) error {
+			return enc.Encode(textRecord{Key: key, Value: val})
+		}
+	case FormatCSV:
+		cw := csv.NewWriter(bw)
+		write = func(key, val string) error {
+			return cw.Write([]string{key, val})
+		}
+		flush = func() error {
+			cw.Flush()
+			return errors.Join(cw.Error(), bw.Flush())
+		}
+		if err := write(csvHeader[0], csvHeader[1]); err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownFormat, opts.Format)
+	}
+
+	err := db.forEachLive(func(key, val string) error {
+		k, err := opts.encode(key)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+		v, err := opts.encode(val)
+		if err != nil {
+			return fmt.Errorf("value of key %q: %w", key, err)
+		}
+		return write(k, v)
+	})
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	if err := flush(); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	return nil
+}
+
+// ImportText sets the keys read from r. It takes the import fast path, the
+// keys are written in batches without fsyncing each one and become durable
+// together once ImportText returns. Keys that are read before an error are
+// kept. It returns the number of keys set, on errors too.
+func (db *DB) ImportText(r io.Reader, opts TextOptions) (int, error) {
+	var next func() (string, string, error)
+	switch opts.Format {
+	case FormatJSONL:
+		dec := json.NewDecoder(bufio.NewReader(r))
+		dec.DisallowUnknownFields()
+		next = func() (string, string, error) {
+			var rec textRecord
+			err := dec.Decode(&rec)
+			return rec.Key, rec.Value, err
+		}
+	case FormatCSV:
+		cr := csv.NewReader(bufio.NewReader(r))
+		cr.FieldsPerRecord = len(csvHeader)
+		cr.ReuseRecord = true
+		hdr, err := cr.Read()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("import: read header: %w", err)
+		}
+		if err == nil && (hdr[0] != csvHeader[0] || hdr[1] != csvHeader[1]) {
+			return 0, fmt.Errorf("import: expected header %q, got %q", csvHeader, hdr)
+		}
+		next = func() (string, string, error) {
+			rec, err := cr.Read()
+			if err != nil {
+				return "", "", err
+			}
+			return rec[0], rec[1], nil
+		}
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownFormat, opts.Format)
+	}
+
+	l := db.newLoader()
+
+	var err error
+	for read := 1; ; read++ {
+		key, val, rerr := next()
+		if errors.Is(rerr, io.EOF) {
+			break
+		}
+		if rerr == nil {
+			key, rerr = opts.decode(key)
+		}
+		if rerr == nil {
+			val, rerr = opts.decode(val)
+		}
+		if rerr != nil {
+			err = fmt.Errorf("import: record %d: %w", read, rerr)
+			break
+		}
+
+		if rerr := l.add(key, val); rerr != nil {
+			err = fmt.Errorf("import: %w", rerr)
+			break
+		}
+	}
+
+	if ferr := l.finish(); ferr != nil {
+		err = errors.Join(err, fmt.Errorf("import: %w", ferr))
+	}
+	return l.written, err
+}
+
+func (opts TextOptions) encode(s string) (string, error) {
+	if opts.Base64 {
+		return base64.StdEncoding.EncodeToString([]byte(s)), nil
+	}
+
+	// json replaces invalid utf-8, and csv readers turn \r\n into \n
+	if !utf8.ValidString(s) || (opts.Format == FormatCSV && strings.ContainsRune(s, '\r')) {
+		return "", errNotText
+	}
+	return s, nil
+}
+
+func (opts TextOptions) decode(s string) (string, error) {
+	if !opts.Base64 {
+		return s, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("decode base64: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImportText(t *testing.T) {
+	vals := map[string]string{
+		"plain":   "value",
+		"quoted":  `say "hi", then "bye"`,
+		"newline": "line1\nline2",
+		"empty":   "",
+	}
+
+	for _, format := range []TextFormat{FormatJSONL, FormatCSV} {
+		for _, b64 := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s base64=%v", format, b64), func(t *testing.T) {
+				db, _, _ := SetupTempDB(t, WithRolloverThreshold(100), WithMergeEnabled(false))
+				for key, val := range vals {
+					_ = db.Set(key, "old")
+					_ = db.Set(key, val)
+				}
+				_ = db.Set("deleted", "x")
+				_ = db.Delete("deleted")
+
+				opts := TextOptions{Format: format, Base64: b64}
+
+				var buf bytes.Buffer
+				if err := db.ExportText(&buf, opts); err != nil {
+					t.Fatalf("export: %v", err)
+				}
+
+				db2, _, _ := SetupTempDB(t, WithRolloverThreshold(100), WithMergeEnabled(false))
+				n, err := db2.ImportText(&buf, opts)
+				if err != nil {
+					t.Fatalf("import: %v", err)
+				}
+				if n != len(vals) || db2.Stats().Keys != len(vals) {
+					t.Fatalf("expected %d keys, imported %d", len(vals), n)
+				}
+				for key, val := range vals {
+					if v, err := db2.Get(key); err != nil || v != val {
+						t.Fatalf("expected %s=%q, got %q, %v", key, val, v, err)
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("binary", func(t *testing.T) {
+		db, _, _ := SetupTempDB(t, WithMergeEnabled(false))
+		bin := "\xff\x00\r\n"
+		_ = db.Set("bin", bin)
+
+		if err := db.ExportText(&bytes.Buffer{}, TextOptions{Format: FormatJSONL}); !errors.Is(err, errNotText) {
+			t.Fatalf("expected binary values to need base64, got %v", err)
+		}
+
+		var buf bytes.Buffer
+		opts := TextOptions{Format: FormatCSV, Base64: true}
+		if err := db.ExportText(&buf, opts); err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		if _, err := db.ImportText(strings.NewReader(buf.String()), opts); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+		if v, err := db.Get("bin"); err != nil || v != bin {
+			t.Fatalf("expected binary value to round trip, got %q, %v", v, err)
+		}
+	})
+
+	t.Run("bad input", func(t *testing.T) {
+		db, _, _ := SetupTempDB(t, WithMergeEnabled(false))
+
+		// the keys before the bad record are kept
+		in := `{"key":"a","value":"1"}` + "\n" + `{"key":"b","value":` + "\n"
+		n, err := db.ImportText(strings.NewReader(in), TextOptions{Format: FormatJSONL})
+		if err == nil || n != 1 {
+			t.Fatalf("expected an error after 1 key, got %d, %v", n, err)
+		}
+		if v, err := db.Get("a"); err != nil || v != "1" {
+			t.Fatalf("expected a=1, got %q, %v", v, err)
+		}
+
+		if _, err := db.ImportText(strings.NewReader("k,v\na,1\n"), TextOptions{Format: FormatCSV}); err == nil {
+			t.Fatalf("expected a bad csv header to fail")
+		}
+		if _, err := db.ImportText(strings.NewReader(""), TextOptions{Format: "xml"}); !errors.Is(err, ErrUnknownFormat) {
+			t.Fatalf("expected unknown format, got %v", err)
+		}
+	})
+
+	t.Run("failed write", func(t *testing.T) {
+		db, _, _ := SetupTempDB(t, WithMergeEnabled(false))
+
+		// writes to a read-only segment fail, the keys of the failed batch aren't counted
+		seg := db.segments[len(db.segments)-1]
+		rw := seg.file
+		seg.file, _ = os.Open(rw.Name())
+		defer func() {
+			_ = seg.file.Close()
+			seg.file = rw
+		}()
+
+		in := "key,value\na,1\nb,2\nc,3\n"
+		n, err := db.ImportText(strings.NewReader(in), TextOptions{Format: FormatCSV})
+		if err == nil || n != 0 {
+			t.Fatalf("expected an error and no keys, got %d, %v", n, err)
+		}
+	})
+}
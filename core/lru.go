@@ -0,0 +1,96 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a least recently used cache bounded by the total cost of its entries.
+// Cost is up to the user, e.g. 1 to bound the entry count, or the value size
+// to bound the memory. It's safe for concurrent use.
+type lru[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	ll       *list.List // front is the most recently used
+	items    map[K]*list.Element
+}
+
+// lruEntryOverhead is the estimated memory cost of an entry besides its key or
+// value bytes: list element, entry, and the map slot pointing to it. It's
+// added to the costs of entries whose costs are in bytes.
+const lruEntryOverhead = 128
+
+type lruEntry[K comparable, V any] struct {
+	key  K
+	val  V
+	cost int64
+}
+
+func newLRU[K comparable, V any](capacity int64) *lru[K, V] {
+	return &lru[K, V]{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[K]*list.Element),
+	}
+}
+
+func (c *lru[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry[K, V]).val, true
+}
+
+// add inserts or replaces the entry of key, evicting the least
+// recently used entries until the total cost fits the capacity.
+// Entries costing more than the capacity are not cached.
+func (c *lru[K, V]) add(key K, val V, cost int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+
+	if cost > c.capacity {
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry[K, V]{key: key, val: val, cost: cost})
+	c.used += cost
+
+	for c.used > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lru[K, V]) remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lru[K, V]) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*lruEntry[K, V])
+	delete(c.items, e.key)
+	c.used -= e.cost
+}
+
+// stats returns the number of entries and their total cost
+func (c *lru[K, V]) stats() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items), c.used
+}
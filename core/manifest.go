@@ -0,0 +1,431 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+)
+
+// MANIFEST lists the segments in the order their records must be replayed.
+// It's an edit log: changes to the segment list are appended as edits, and
+// the current list is the result of replaying them. Once enough edits pile
+// up, the log is compacted into a snapshot that lists every segment again.
+//
+// Layout (little endian, varints are unsigned):
+//
+//	[8-byte magic][2-byte version]
+//	{ [4-byte payload length][8-byte checksum of payload][payload] } ...
+//
+// Payload is a 1-byte edit type followed by the edit:
+//
+//	add:     [segment]                                  segment appended to the list
+//	seal:    [varint id][varint size][varint records]   segment is no longer active
+//	replace: [varint n] { [varint id] } ... [varint m] { [segment] } ...
+//	         n segments are replaced by m merged ones, at the position of the first
+//
+// where segment is [varint id][varint size][varint records][varint generation][1-byte flags].
+//
+// A torn edit at the end, from a crash while appending, is dropped. Any other
+// damage makes the manifest unusable. Manifests written before this format,
+// whitespace separated ids, are still read and get rewritten in this format.
+const manifestName = "MANIFEST"
+
+const manifestVersion = 1
+
+const manifestHdrLen = 10 // magic + version
+
+const manifestFrameLen = 12 // payload length + checksum
+
+// compact the manifest once this many edits are appended after the last snapshot
+const manifestCompactEdits = 1000
+
+var manifestMagic = []byte("BITDBMNF")
+
+var ErrManifestCorrupt = errors.New("manifest corrupt")
+
+const (
+	editAdd byte = iota + 1
+	editSeal
+	editReplace
+)
+
+// segment flags kept in the manifest
+const (
+	metaSealed = 1 << iota
+	metaMerged
+)
+
+// segmentMeta is what the manifest knows about a segment
+type segmentMeta struct {
+	id         int
+	size       int64 // final size of the segment, 0 while it's active
+	records    int64 // record count of the segment, 0 while it's active
+	generation int   // 0 for segments written by Set and Delete, merge outputs are one more than their newest input
+	flags      uint8
+}
+
+func (m segmentMeta) sealed() bool { return m.flags&metaSealed != 0 }
+
+// manifestState is the result of reading the manifest
+type manifestState struct {
+	segs   []segmentMeta
+	legacy bool  // written in the old text format, or empty
+	end    int64 // end of the last intact edit
+	edits  int   // number of edits in the log, including the snapshot
+}
+
+func (st *manifestState) ids() []int {
+	ids := make([]int, len(st.segs))
+	for i, m := range st.segs {
+		ids[i] = m.id
+	}
+	return ids
+}
+
+// readManifest reads and replays the manifest at path
+func readManifest(path string) (*manifestState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	return parseManifest(data)
+}
+
+func parseManifest(data []byte) (*manifestState, error) {
+	if len(data) < len(manifestMagic) || string(data[:len(manifestMagic)]) != string(manifestMagic) {
+		return parseLegacyManifest(data)
+	}
+
+	if len(data) < manifestHdrLen {
+		return nil, fmt.Errorf("%w: truncated header", ErrManifestCorrupt)
+	}
+
+	if v := binary.LittleEndian.Uint16(data[len(manifestMagic):]); v != manifestVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrManifestCorrupt, v)
+	}
+
+	st := &manifestState{end: manifestHdrLen}
+	for rest := data[manifestHdrLen:]; len(rest) > 0; {
+		if len(rest) < manifestFrameLen {
+			break // torn frame
+		}
+
+		n := int64(binary.LittleEndian.Uint32(rest))
+		if int64(len(rest)-manifestFrameLen) < n {
+			break // torn payload
+		}
+
+		sum, payload := binary.LittleEndian.Uint64(rest[4:]), rest[manifestFrameLen:manifestFrameLen+n]
+		if computed := xxh3.Hash(payload); computed != sum {
+			// the last edit may be written only partly, the file
+			// is extended before all of its bytes reach the disk
+			if int64(len(rest)) == manifestFrameLen+n {
+				break
+			}
+			return nil, fmt.Errorf("%w: edit at %d: %w: expected %x, got %x",
+				ErrManifestCorrupt, st.end, ErrChecksumMismatch, sum, computed)
+		}
+
+		if err := st.apply(payload); err != nil {
+			return nil, fmt.Errorf("%w: edit at %d: %w", ErrManifestCorrupt, st.end, err)
+		}
+
+		st.end += manifestFrameLen + n
+		st.edits++
+		rest = rest[manifestFrameLen+n:]
+	}
+
+	return st, nil
+}
+
+func parseLegacyManifest(data []byte) (*manifestState, error) {
+	st := &manifestState{legacy: true}
+	for _, idStr := range strings.Fields(string(data)) {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrManifestCorrupt, err)
+		}
+		st.segs = append(st.segs, segmentMeta{id: id})
+	}
+	return st, nil
+}
+
+// apply replays a single edit
+func (st *manifestState) apply(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("empty edit")
+	}
+
+	r := &byteReader{buf: payload[1:]}
+	switch payload[0] {
+	case editAdd:
+		m := readSegmentMeta(r)
+		if r.err == nil && st.index(m.id) >= 0 {
+			return fmt.Errorf("segment %d is added twice", m.id)
+		}
+		st.segs = append(st.segs, m)
+	case editSeal:
+		id, size, records := int(r.uvarint()), int64(r.uvarint()), int64(r.uvarint())
+		if r.err != nil {
+			break
+		}
+		i := st.index(id)
+		if i < 0 {
+			return fmt.Errorf("sealed segment %d is not listed", id)
+		}
+		st.segs[i].size, st.segs[i].records = size, records
+		st.segs[i].flags |= metaSealed
+	case editReplace:
+		removed := make([]int, r.uvarint())
+		for i := range removed {
+			removed[i] = int(r.uvarint())
+		}
+		added := make([]segmentMeta, r.uvarint())
+		for i := range added {
+			added[i] = readSegmentMeta(r)
+		}
+		if r.err != nil {
+			break
+		}
+		return st.replace(removed, added)
+	default:
+		return fmt.Errorf("unknown edit type %d", payload[0])
+	}
+
+	return r.err
+}
+
+func (st *manifestState) replace(removed []int, added []segmentMeta) error {
+	at := len(st.segs)
+	for _, id := range removed {
+		i := st.index(id)
+		if i < 0 {
+			return fmt.Errorf("replaced segment %d is not listed", id)
+		}
+		at = min(at, i)
+	}
+
+	st.segs = slices.DeleteFunc(st.segs, func(m segmentMeta) bool { return slices.Contains(removed, m.id) })
+	st.segs = slices.Insert(st.segs, min(at, len(st.segs)), added...)
+	return nil
+}
+
+func (st *manifestState) index(id int) int {
+	return slices.IndexFunc(st.segs, func(m segmentMeta) bool { return m.id == id })
+}
+
+func readSegmentMeta(r *byteReader) segmentMeta {
+	m := segmentMeta{
+		id:         int(r.uvarint()),
+		size:       int64(r.uvarint()),
+		records:    int64(r.uvarint()),
+		generation: int(r.uvarint()),
+	}
+	if b := r.bytes(1); b != nil {
+		m.flags = b[0]
+	}
+	return m
+}
+
+func appendSegmentMeta(buf []byte, m segmentMeta) []byte {
+	buf = binary.AppendUvarint(buf, uint64(m.id))
+	buf = binary.AppendUvarint(buf, uint64(m.size))
+	buf = binary.AppendUvarint(buf, uint64(m.records))
+	buf = binary.AppendUvarint(buf, uint64(m.generation))
+	return append(buf, m.flags)
+}
+
+// appendEdit frames an edit payload and appends it to buf
+func appendEdit(buf []byte, payload []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.LittleEndian.AppendUint64(buf, xxh3.Hash(payload))
+	return append(buf, payload...)
+}
+
+func addEdit(m segmentMeta) []byte {
+	return appendSegmentMeta([]byte{editAdd}, m)
+}
+
+func sealEdit(seg *segment) []byte {
+	buf := binary.AppendUvarint([]byte{editSeal}, uint64(seg.id))
+	buf = binary.AppendUvarint(buf, uint64(seg.size))
+	return binary.AppendUvarint(buf, uint64(seg.records))
+}
+
+func replaceEdit(removed []*segment, added []segmentMeta) []byte {
+	buf := binary.AppendUvarint([]byte{editReplace}, uint64(len(removed)))
+	for _, seg := range removed {
+		buf = binary.AppendUvarint(buf, uint64(seg.id))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(added)))
+	for _, m := range added {
+		buf = appendSegmentMeta(buf, m)
+	}
+	return buf
+}
+
+// openManifest opens the manifest, creating it if it doesn't exist,
+// and replays it. A torn edit at the end is truncated.
+func openManifest(dir string) (*os.File, *manifestState, error) {
+	path := filepath.Join(dir, manifestName)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if os.IsNotExist(err) {
+		f, err = createFileDurable(dir, manifestName)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("open manifest: %w", err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	st, err := parseManifest(data)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	if !st.legacy && st.end < int64(len(data)) {
+		log.Printf("manifest: dropping torn edit at %d", st.end)
+		if err := f.Truncate(st.end); err != nil {
+			_ = f.Close()
+			return nil, nil, fmt.Errorf("truncate manifest: %w", err)
+		}
+	}
+
+	return f, st, nil
+}
+
+// segmentMeta describes seg for the manifest. Caller must hold the db lock.
+func (db *DB) segmentMeta(seg *segment, sealed bool) segmentMeta {
+	m := segmentMeta{id: seg.id, generation: seg.generation}
+	if sealed {
+		m.size, m.records = seg.size, seg.records
+		m.flags |= metaSealed
+	}
+	if seg.hdr.flags&segFlagMerged != 0 {
+		m.flags |= metaMerged
+	}
+	return m
+}
+
+// segmentMetas describes all segments for the manifest, the last one is active.
+// Caller must hold the db lock.
+func (db *DB) segmentMetas() []segmentMeta {
+	metas := make([]segmentMeta, len(db.segments))
+	for i, seg := range db.segments {
+		isActive := i == len(db.segments)-1
+		metas[i] = db.segmentMeta(seg, !isActive)
+	}
+	return metas
+}
+
+// encodeManifestSnapshot encodes a manifest that adds the segments in order
+func encodeManifestSnapshot(metas []segmentMeta) []byte {
+	buf := append([]byte(nil), manifestMagic...)
+	buf = binary.LittleEndian.AppendUint16(buf, manifestVersion)
+
+	for _, m := range metas {
+		buf = appendEdit(buf, addEdit(m))
+	}
+	return buf
+}
+
+// applySegmentMetas restores what the manifest knows about the loaded segments
+func (db *DB) applySegmentMetas(metas []segmentMeta) {
+	for _, m := range metas {
+		seg, ok := db.segById[m.id]
+		if !ok {
+			continue
+		}
+
+		seg.generation = m.generation
+		if m.sealed() && (m.size != seg.size || m.records != seg.records) {
+			log.Printf("warning: segment %d has %d bytes and %d records, manifest says %d bytes and %d records",
+				seg.id, seg.size, seg.records, m.size, m.records)
+		}
+	}
+}
+
+// logManifest appends the edits to the manifest and syncs it, compacting
+// the manifest if it has grown too long. Caller must hold the db lock.
+func (db *DB) logManifest(edits ...[]byte) error {
+	if err := db.appendManifest(edits...); err != nil {
+		return err
+	}
+	return db.maybeCompactManifest()
+}
+
+// appendManifest appends the edits to the manifest and syncs it. On failure
+// the manifest is left as it was. Caller must hold the db lock.
+func (db *DB) appendManifest(edits ...[]byte) error {
+	var buf []byte
+	for _, e := range edits {
+		buf = appendEdit(buf, e)
+	}
+
+	end, err := db.manifest.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seek manifest: %w", err)
+	}
+
+	if _, err := db.manifestWrite(db.manifest, buf); err != nil {
+		return errors.Join(fmt.Errorf("append manifest: %w", err), db.truncateManifest(end))
+	}
+
+	if err := db.manifest.Sync(); err != nil {
+		return errors.Join(fmt.Errorf("sync manifest: %w", err), db.truncateManifest(end))
+	}
+
+	db.manifestEdits += len(edits)
+	return nil
+}
+
+// maybeCompactManifest compacts the manifest once it has grown too long.
+// Caller must hold the db lock.
+func (db *DB) maybeCompactManifest() error {
+	// a snapshot takes one edit per segment, the rest are appended since
+	if db.manifestEdits-len(db.segments) >= manifestCompactEdits {
+		return db.compactManifest()
+	}
+	return nil
+}
+
+// truncateManifest drops a partial append after end, so the
+// next edit doesn't follow a frame with a bad checksum
+func (db *DB) truncateManifest(end int64) error {
+	if err := db.manifest.Truncate(end); err != nil {
+		return fmt.Errorf("truncate manifest: %w", err)
+	}
+	if _, err := db.manifest.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("seek manifest: %w", err)
+	}
+	return nil
+}
+
+// compactManifest atomically replaces the manifest with a snapshot
+// of the current segment list. Caller must hold the db lock.
+func (db *DB) compactManifest() error {
+	newf, err := writeFileAtomic(db.manifest, encodeManifestSnapshot(db.segmentMetas()))
+	if err != nil {
+		return fmt.Errorf("atomic write: %w", err)
+	}
+
+	db.manifest = newf
+	db.manifestEdits = len(db.segments)
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestManifestEditLog(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+
+	for _, k := range []string{"a", "b", "c"} {
+		_ = db.Set(k, "1")
+	}
+	_ = db.Close()
+
+	mnf, err := readManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+
+	// snapshot of the first segment, then a seal and an add per rollover
+	if got, want := mnf.edits, 1+3*2; got != want {
+		t.Fatalf("expected %d edits, got %d", want, got)
+	}
+
+	if got, want := mnf.ids(), []int{1, 2, 3, 4}; !slices.Equal(got, want) {
+		t.Fatalf("expected segments %v, got %v", want, got)
+	}
+
+	for i, m := range mnf.segs {
+		isActive := i == len(mnf.segs)-1
+		if m.sealed() == isActive {
+			t.Fatalf("segment %d: unexpected sealed flag %v", m.id, m.sealed())
+		}
+		if !isActive && (m.records != 1 || m.size != segHdrLen+hdrLen+2) {
+			t.Fatalf("segment %d: unexpected meta %+v", m.id, m)
+		}
+	}
+
+	db2, err := Open(dir, WithRolloverThreshold(1), WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	for _, k := range []string{"a", "b", "c"} {
+		if v, err := db2.Get(k); err != nil || v != "1" {
+			t.Errorf("expected %s=1, got %q, %v", k, v, err)
+		}
+	}
+
+	// compaction is due on the next edit, it leaves a snapshot behind
+	db2.manifestEdits = manifestCompactEdits + len(db2.segments) - 1
+	_ = db2.Set("d", "1")
+
+	mnf, err = readManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatalf("read compacted manifest: %v", err)
+	}
+	if mnf.edits != len(mnf.segs) || len(mnf.segs) != 5 {
+		t.Fatalf("expected a snapshot of 5 segments, got %d edits for %v", mnf.edits, mnf.ids())
+	}
+}
+
+func TestManifestShortWrite(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+
+	// the rollover of a's segment writes half of its edits
+	db.manifestWrite = func(f *os.File, b []byte) (int, error) {
+		n, _ := f.Write(b[:len(b)/2])
+		return n, errors.New("disk full")
+	}
+	if err := db.Set("a", "1"); err == nil {
+		t.Fatalf("expected the rollover to fail")
+	}
+	if len(db.segments) != 1 {
+		t.Fatalf("expected the failed rollover to keep one segment, got %d", len(db.segments))
+	}
+
+	db.manifestWrite = (*os.File).Write
+	_ = db.Set("b", "1")
+	_ = db.Close()
+
+	db2, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("reopen after a short manifest write: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	for _, k := range []string{"a", "b"} {
+		if v, err := db2.Get(k); err != nil || v != "1" {
+			t.Errorf("expected %s=1, got %q, %v", k, v, err)
+		}
+	}
+}
+
+func TestManifestLegacyFormat(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "2")
+	_ = db.Close()
+
+	path := filepath.Join(dir, manifestName)
+	_ = os.WriteFile(path, []byte("1\n2\n3\n"), 0o644)
+
+	db2, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open with legacy manifest: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if v, err := db2.Get("b"); err != nil || v != "2" {
+		t.Fatalf("expected b=2, got %q, %v", v, err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(data, manifestMagic) {
+		t.Fatalf("expected legacy manifest to be rewritten")
+	}
+
+	mnf, err := parseManifest(data)
+	if err != nil || !slices.Equal(mnf.ids(), []int{1, 2, 3}) || !mnf.segs[0].sealed() {
+		t.Fatalf("unexpected rewritten manifest: %+v, %v", mnf, err)
+	}
+}
+
+func TestManifestDamage(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "2")
+	_ = db.Close()
+
+	path := filepath.Join(dir, manifestName)
+	data, _ := os.ReadFile(path)
+
+	// a torn edit at the end is dropped
+	torn := append(bytes.Clone(data), appendEdit(nil, addEdit(segmentMeta{id: 9}))[:15]...)
+	_ = os.WriteFile(path, torn, 0o644)
+
+	db2, err := Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open with torn manifest: %v", err)
+	}
+	if v, err := db2.Get("b"); err != nil || v != "2" {
+		t.Fatalf("expected b=2, got %q, %v", v, err)
+	}
+	_ = db2.Close()
+
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("expected torn edit to be truncated, size %d, want %d", info.Size(), len(data))
+	}
+
+	// so is one with all of its bytes, but not their contents
+	garbled := appendEdit(nil, addEdit(segmentMeta{id: 9}))
+	garbled[len(garbled)-1] ^= 0xff
+	_ = os.WriteFile(path, append(bytes.Clone(data), garbled...), 0o644)
+
+	db2, err = Open(dir, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open with garbled last edit: %v", err)
+	}
+	_ = db2.Close()
+
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("expected garbled edit to be truncated, size %d, want %d", info.Size(), len(data))
+	}
+
+	// damage in the middle is fatal
+	corrupted := bytes.Clone(data)
+	corrupted[manifestHdrLen+manifestFrameLen+1] ^= 0xff
+	_ = os.WriteFile(path, corrupted, 0o644)
+
+	if _, err := Open(dir, WithMergeEnabled(false)); !errors.Is(err, ErrManifestCorrupt) {
+		t.Fatalf("expected manifest corrupt, got %v", err)
+	}
+}
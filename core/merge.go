@@ -5,17 +5,27 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 )
 
 type mergeOutput struct {
-	segments     []*segment
-	indexChanges map[string][2]*recordLocation
+	segments          []*segment
+	generation        int // generation of the output segments
+	indexChanges      map[string][2]recordLocation
+	tombstoneChanges  map[string][2]recordLocation // tombstones carried over to the output
+	droppedTombstones map[string]recordLocation    // tombstones proven obsolete by the merge
+
+	// older records of live keys held back until their latest record is
+	// copied, when merge keeps versions. nil otherwise.
+	versions map[string]*keyVersions
 }
 
 func newMergeOutput() *mergeOutput {
 	return &mergeOutput{
-		segments:     make([]*segment, 0),
-		indexChanges: make(map[string][2]*recordLocation),
+		segments:          make([]*segment, 0),
+		indexChanges:      make(map[string][2]recordLocation),
+		tombstoneChanges:  make(map[string][2]recordLocation),
+		droppedTombstones: make(map[string]recordLocation),
 	}
 }
 
@@ -40,27 +50,49 @@ func (db *DB) MergeErrors() <-chan error { return db.mergeErr }
 
 func (db *DB) rolloverMergeSegment(out *mergeOutput) (*segment, error) {
 	// create a new merge segment
-	seg, err := newSegment(db.dir, db.claimNextSegmentId())
+	seg, err := newSegment(db.dir, db.claimNextSegmentId(), segFlagMerged)
 	if err != nil {
 		return nil, fmt.Errorf("create merge segment: %w", err)
 	}
 
+	seg.generation = out.generation
 	out.segments = append(out.segments, seg)
 	return seg, nil
 }
 
+// mergeRange returns the [lo, hi) range of db.segments that the next merge will process.
+// Caller must hold the db lock.
+func (db *DB) mergeRange() (int, int) {
+	hi := len(db.segments) - 1 // leave out last(active) segment
+	lo := 0
+	if db.mergeMaxSegments > 0 && hi-lo > db.mergeMaxSegments {
+		lo = hi - db.mergeMaxSegments
+	}
+	return lo, hi
+}
+
 func (db *DB) merge() (rerr error) {
 	// we will only merge inactive segments because they are read-only
 	// new segments added during the merge are also out of scope
 	db.rw.RLock()
-	inputLen := len(db.segments) - 1 // leave out last(active) segment
-	toMerge := db.segments[:inputLen]
+	lo, hi := db.mergeRange()
+	toMerge := db.segments[lo:hi]
 	db.rw.RUnlock()
 
+	// a tombstone hides the older values of its key. if there are segments
+	// older than the merged range, they may still contain such values, so
+	// the tombstone must survive the merge. otherwise it's obsolete.
+	// merges are serialized and only append to db.segments otherwise,
+	// so lo stays valid until we apply the merge.
+	keepTombstones := lo > 0
+
 	// input segments are decided, run the callback for testing
 	db.onMergeStart()
 
 	out := newMergeOutput()
+	for _, seg := range toMerge {
+		out.generation = max(out.generation, seg.generation+1)
+	}
 
 	defer func() {
 		// in case of an unhandled error, we're rolling back
@@ -72,62 +104,27 @@ func (db *DB) merge() (rerr error) {
 		}
 	}()
 
-	mergeSeg, err := db.rolloverMergeSegment(out)
-	if err != nil {
+	if _, err := db.rolloverMergeSegment(out); err != nil {
 		return fmt.Errorf("rollover merge segment: %w", err)
 	}
 
-	for _, seg := range toMerge {
-		// we don't do corruption checks on merge, there's not much point
-		rs := newRecordScanner(seg.file, false)
-		for rs.scan() {
-			rec := rs.record
-
-			db.rw.RLock()
-			loc, ok := db.index[rec.key]
-			db.rw.RUnlock()
-
-			// db.index is guaranteed to be in a more recent state
-			// than `toMerge` segments. so if `key` doesn't exist
-			// in db.index, we can safely skip this record
-			if !ok {
-				continue
-			}
-
-			// we will include latest occurrence of the record
-			// in the new segment and update the merge index
-			isLatest := loc.seg == seg && loc.offset == rec.off
-
-			// skip if not latest
-			if !isLatest {
-				continue
-			}
-
-			// prepare new segment if we grew over the limit
-			// rollover should happen only when there's still
-			// records left, that's why it's before write.
-			if mergeSeg.size >= db.rolloverThreshold {
-				if mergeSeg, err = db.rolloverMergeSegment(out); err != nil {
-					return fmt.Errorf("rollover merge segment: %w", err)
-				}
-			}
+	if db.keepingVersions() {
+		out.versions = make(map[string]*keyVersions)
+	}
 
-			off, err := mergeSeg.write(rec.key, rec.val, TypeSet, db.fsync)
-			if err != nil {
-				return fmt.Errorf("write key %q on segment %d: %w", rec.key, mergeSeg.id, err)
+	for _, seg := range toMerge {
+		// regions skipped on Open hold no records, they're left out
+		for _, r := range seg.validRanges() {
+			if err := db.mergeRecords(out, seg, r[0], r[1], keepTombstones); err != nil {
+				return err
 			}
-
-			// we memorize the both the old and the new location of the record
-			// while merging to index, we need to make sure we're not replacing
-			// a newer value of the key (explained below)
-			out.indexChanges[rec.key] = [2]*recordLocation{loc, {
-				seg:    mergeSeg,
-				offset: off,
-			}}
 		}
+	}
 
-		if err = rs.err; err != nil {
-			return fmt.Errorf("scan segment %d: %w", seg.id, err)
+	// keys whose latest record is newer than the merge input
+	for key := range out.versions {
+		if err := db.flushVersions(out, key); err != nil {
+			return fmt.Errorf("merge versions of key %q: %w", key, err)
 		}
 	}
 
@@ -147,9 +144,27 @@ func (db *DB) merge() (rerr error) {
 	db.rw.Lock()
 	defer db.rw.Unlock()
 
-	// merged segments replace their corresponding `inputLen` counterpart
-	// and un-merged segments are appended
-	db.segments = append(out.segments, db.segments[inputLen:]...)
+	// merged segments replace their input range, segments before
+	// and after the range keep their places
+	segments := slices.Clone(db.segments[:lo])
+	segments = append(segments, out.segments...)
+	db.segments = append(segments, db.segments[hi:]...)
+
+	for _, seg := range out.segments {
+		db.segById[seg.id] = seg
+		if db.mmapReads {
+			seg.mapForReads()
+		}
+	}
+	for _, seg := range toMerge {
+		delete(db.segById, seg.id)
+	}
+
+	// the regions skipped on Open are gone with their segments
+	db.corruptions = slices.DeleteFunc(db.corruptions, func(c Corruption) bool {
+		_, ok := db.segById[c.Segment]
+		return !ok
+	})
 
 	// overwrite index with merged entries
 	// however, we should be careful about the updated keys
@@ -157,7 +172,7 @@ func (db *DB) merge() (rerr error) {
 	// while we're busy with creating merge segments,
 	// in that case we skip updating the key
 	for key, locs := range out.indexChanges {
-		curLoc, ok := db.index[key]
+		curLoc, ok := db.index.get(key)
 		if !ok {
 			// deleted on db, skip
 			continue
@@ -169,39 +184,211 @@ func (db *DB) merge() (rerr error) {
 		locBefore := locs[0] // to be replaced
 		locAfter := locs[1]  // possible replacer
 
-		isLatest := locBefore.seg == curLoc.seg && locBefore.offset == curLoc.offset
+		isLatest := locBefore == curLoc
 		if !isLatest {
 			continue
 		}
 
 		// most recent. replace!
-		db.index[key] = locAfter
+		db.index.put(key, locAfter)
+		db.valueCache.move(locBefore, locAfter)
+
+	}
+
+	// same for tombstones. if the key got set or deleted again
+	// during the merge, the tombstone we handled is not the latest
+	for key, locs := range out.tombstoneChanges {
+		if curLoc, ok := db.tombstones.get(key); ok && curLoc == locs[0] {
+			db.tombstones.put(key, locs[1])
+		}
+	}
 
+	for key, loc := range out.droppedTombstones {
+		if curLoc, ok := db.tombstones.get(key); ok && curLoc == loc {
+			db.tombstones.delete(key)
+		}
+	}
+
+	metas := make([]segmentMeta, len(out.segments))
+	for i, seg := range out.segments {
+		metas[i] = db.segmentMeta(seg, true)
 	}
 
-	if err := db.overwriteManifest(); err != nil {
-		return fmt.Errorf("overwrite manifest: %w", err)
+	if err := db.logManifest(replaceEdit(toMerge, metas)); err != nil {
+		return fmt.Errorf("log manifest: %w", err)
 	}
 
-	// remove old segment files; ignore errors and log them
+	// remove old segment files, unless a backup still needs them; ignore errors and log them
+	// no reads are in flight since we hold the lock, so unmapping them is safe
 	for _, seg := range toMerge {
-		if err := seg.file.Close(); err != nil {
+		if err := seg.close(); err != nil {
 			log.Printf("close old segment %d: %v", seg.id, err)
 		}
 
-		if err := os.Remove(getSegmentPath(db.dir, seg.id)); err != nil {
-			log.Printf("remove old segment %d: %v", seg.id, err)
+		db.removeSegmentFile(seg.id)
+	}
+
+	// the merge is applied already, a failure only shortens the retention window
+	if db.history != nil {
+		if err := db.recordMerge(toMerge, out.segments); err != nil {
+			log.Printf("record merge in retention history: %v", err)
 		}
 	}
 
 	return nil
 }
 
+// mergeRecords copies the latest records in [start, end) of seg to the merge output.
+func (db *DB) mergeRecords(out *mergeOutput, seg *segment, start, end int64, keepTombstones bool) error {
+	// we don't do corruption checks on merge, there's not much point
+	// we only read headers and keys here, values are read just for
+	// the records we keep, and copied over without decoding.
+	rs := newRecordScannerRange(seg.file, start, end, false)
+	for rs.scanHeader() {
+		if rs.wt == TypeDelete {
+			if err := db.mergeTombstone(out, seg, rs, keepTombstones); err != nil {
+				return err
+			}
+			continue
+		}
+
+		db.rw.RLock()
+		loc, ok := db.index.getBytes(rs.key)
+		db.rw.RUnlock()
+
+		// db.index is guaranteed to be in a more recent state
+		// than `toMerge` segments. so if `key` doesn't exist
+		// in db.index, we can safely skip this record
+		if !ok {
+			continue
+		}
+
+		// we will include latest occurrence of the record
+		// in the new segment and update the merge index
+		isLatest := loc.at(seg, rs.off)
+
+		// older versions are skipped unless merge keeps them, the index
+		// doesn't point to them. value gets skipped on the next scanHeader
+		if !isLatest {
+			if out.versions != nil {
+				if err := db.mergeVersion(out, seg, rs); err != nil {
+					return fmt.Errorf("merge version of key %q: %w", rs.key, err)
+				}
+			}
+			continue
+		}
+
+		// the versions kept go right before the latest one
+		if out.versions != nil {
+			if err := db.flushVersions(out, string(rs.key)); err != nil {
+				return fmt.Errorf("merge versions of key %q: %w", rs.key, err)
+			}
+		}
+
+		newLoc, ok, err := db.copyMergeRecord(out, rs)
+		if err != nil {
+			return err
+		}
+
+		// partially written record, nothing left to merge in this range
+		if !ok {
+			break
+		}
+
+		// we memorize the both the old and the new location of the record
+		// while merging to index, we need to make sure we're not replacing
+		// a newer value of the key (explained in merge)
+		out.indexChanges[string(rs.key)] = [2]recordLocation{loc, newLoc}
+	}
+
+	if err := rs.err; err != nil {
+		return fmt.Errorf("scan segment %d: %w", seg.id, err)
+	}
+
+	return nil
+}
+
+// copyMergeRecord reads the current record of rs and appends its raw bytes to the
+// last merge output segment. It returns the new location of the record, or false
+// if the record turns out to be partially written.
+func (db *DB) copyMergeRecord(out *mergeOutput, rs *recordScanner) (recordLocation, bool, error) {
+	// the value may be read already to decide whether to copy the record
+	if rs.pending && !rs.readValue() {
+		if rs.err != nil {
+			return recordLocation{}, false, fmt.Errorf("read value of key %q: %w", rs.key, rs.err)
+		}
+		return recordLocation{}, false, nil
+	}
+
+	loc, err := db.writeMergeRecord(out, rs.raw())
+	if err != nil {
+		return recordLocation{}, false, fmt.Errorf("write key %q: %w", rs.key, err)
+	}
+
+	loc.valSize = uint32(rs.valSize())
+	return loc, true, nil
+}
+
+// writeMergeRecord appends the raw bytes of a record to the last merge output segment
+func (db *DB) writeMergeRecord(out *mergeOutput, raw []byte) (recordLocation, error) {
+	mergeSeg := out.segments[len(out.segments)-1]
+
+	// prepare new segment if we grew over the limit
+	// rollover should happen only when there's still
+	// records left, that's why it's before write.
+	if mergeSeg.dataSize() >= db.rolloverThreshold {
+		var err error
+		if mergeSeg, err = db.rolloverMergeSegment(out); err != nil {
+			return recordLocation{}, fmt.Errorf("rollover merge segment: %w", err)
+		}
+	}
+
+	// record is copied as is, along with its checksum
+	off, err := mergeSeg.writeRaw(raw, db.fsync)
+	if err != nil {
+		return recordLocation{}, fmt.Errorf("write on segment %d: %w", mergeSeg.id, err)
+	}
+
+	return recordLocation{segId: uint32(mergeSeg.id), offset: off}, nil
+}
+
+// mergeTombstone handles a tombstone record found in merge input. Tombstones that
+// are superseded by a newer write are skipped. The latest tombstone of a key is
+// either carried over to the merge output or dropped when it's obsolete.
+func (db *DB) mergeTombstone(out *mergeOutput, seg *segment, rs *recordScanner, keep bool) error {
+	db.rw.RLock()
+	loc, ok := db.tombstones.getBytes(rs.key)
+	_, live := db.index.getBytes(rs.key)
+	db.rw.RUnlock()
+
+	// key is set again or deleted later, this tombstone is not needed,
+	// unless it's in the history of a live key that merge keeps
+	if !ok || !loc.at(seg, rs.off) {
+		if live && out.versions != nil {
+			return db.mergeVersion(out, seg, rs)
+		}
+		return nil
+	}
+
+	if !keep {
+		out.droppedTombstones[string(rs.key)] = loc
+		return nil
+	}
+
+	newLoc, ok, err := db.copyMergeRecord(out, rs)
+	if err != nil || !ok {
+		return err
+	}
+
+	out.tombstoneChanges[string(rs.key)] = [2]recordLocation{loc, newLoc}
+	return nil
+}
+
 func (db *DB) abortMerge(out *mergeOutput) (errs error) {
 	log.Println("merge failed, releasing resources...")
 
 	for _, seg := range out.segments {
-		if err := seg.file.Close(); err != nil {
+		if err := seg.close(); err != nil {
 			errs = errors.Join(errs, fmt.Errorf("close segment %d: %w", seg.id, err))
 		}
 
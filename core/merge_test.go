@@ -9,7 +9,6 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"testing"
 	"testing/synctest"
@@ -430,7 +429,7 @@ func TestMergeAfterTruncatedRecord(t *testing.T) {
 
 		// k2, the truncated record, did not get included into the merged segment,
 		// but its entry in db.index points to its location in the deleted segment.
-		// So we expect a file closed error when trying to call seg.file.Read
+		// So we expect a closed error since that segment is gone
 		if v, err := db.Get("k2"); !errors.Is(err, fs.ErrClosed) {
 			t.Fatalf("expected k2 to lead to file closed error, but got value: %q %v", v, err)
 		}
@@ -474,8 +473,7 @@ func TestMergeDeletesOldSegments(t *testing.T) {
 				// get the segments that will be merged
 				db.rw.RLock()
 				for _, seg := range db.segments[:len(db.segments)-1] {
-					// seg001, seg002, seg003
-					segsBefore.Add(fmt.Sprintf("seg%03d", seg.id))
+					segsBefore.Add(segmentFileName(seg.id))
 				}
 				db.rw.RUnlock()
 
@@ -517,20 +515,19 @@ func TestMergeDeletesOldSegments(t *testing.T) {
 		}
 
 		// Validate MANIFEST lists the ids of updated db.segments only.
-		manPath := filepath.Join(dir, "MANIFEST")
-		manBytes, err := os.ReadFile(manPath)
+		mnf, err := readManifest(filepath.Join(dir, manifestName))
 		if err != nil {
 			t.Fatalf("read manifest: %v", err)
 		}
 
-		// parse manifest ids to a set
-		manIds := mapset.NewSet(strings.Fields(string(manBytes))...)
+		// manifest ids as a set
+		manIds := mapset.NewSet(mnf.ids()...)
 
 		// get the updated db.segments
-		wantIds := mapset.NewSet[string]()
+		wantIds := mapset.NewSet[int]()
 		db.rw.RLock()
 		for _, seg := range db.segments {
-			wantIds.Add(fmt.Sprintf("%d", seg.id))
+			wantIds.Add(seg.id)
 		}
 		db.rw.RUnlock()
 
@@ -606,7 +603,7 @@ func TestMergeRollbackOnError(t *testing.T) {
 		}
 		wantFiles := mapset.NewSet[string]("MANIFEST")
 		for _, id := range wantIDs {
-			wantFiles.Add(fmt.Sprintf("seg%03d", id))
+			wantFiles.Add(segmentFileName(id))
 		}
 		if !files.Equal(wantFiles) {
 			t.Fatalf("unexpected files after failed merge: %v, want %v", files, wantFiles)
@@ -643,8 +640,8 @@ func TestMergeHandlesDeletedKeys(t *testing.T) {
 		}
 
 		// Verify merged segment is empty
-		if seg := db.segments[0]; seg.size > 0 {
-			t.Errorf("merged segment %d should be empty but has size %d", seg.id, seg.size)
+		if seg := db.segments[0]; seg.dataSize() > 0 {
+			t.Errorf("merged segment %d should be empty but has %d bytes of records", seg.id, seg.dataSize())
 		}
 
 		// Verify no data remains in merge segment by checking total disk size
@@ -653,7 +650,8 @@ func TestMergeHandlesDeletedKeys(t *testing.T) {
 			t.Fatalf("DiskSize failed: %v", err)
 		}
 
-		if totalSize > 0 {
+		// only the segment headers are left
+		if totalSize > 2*segHdrLen {
 			t.Errorf("expected no disk usage after deleting everything, got %d bytes", totalSize)
 		}
 
@@ -709,3 +707,199 @@ func TestMergeDoesNotOverwriteNewerValues(t *testing.T) {
 		}
 	})
 }
+
+// TestPartialMergeKeepsTombstones merges only the newest inactive segment. The
+// tombstone in it hides a value in an older, un-merged segment, so it has to be
+// carried over to the merged segment and survive a reopen.
+func TestPartialMergeKeepsTombstones(t *testing.T) {
+	synctest.Run(func() {
+		opts := []Option{
+			WithRolloverThreshold(30),
+			WithMergeThreshold(2),
+			WithMergeMaxSegments(1), // only merge the newest inactive segment
+			WithMergeEnabled(true),
+		}
+		db, dir, _ := SetupTempDB(t, opts...)
+
+		_ = db.Set("k1", "v1")
+		_ = db.Set("k2", "v2") // seg001 rollover
+		_ = db.Delete("k1")
+		_ = db.Set("k3", "v3") // seg002 rollover, triggers merge of seg002 only
+
+		synctest.Wait()
+
+		// seg001 is untouched, seg002 is replaced by seg004 in place
+		want := []int{1, 4, 3}
+		for i, seg := range db.segments {
+			if seg.id != want[i] {
+				t.Fatalf("expected seg id %d, got %d", want[i], seg.id)
+			}
+		}
+
+		// merged segment holds both the tombstone and k3
+		if got, want := db.segments[1].dataSize(), int64(hdrLen+2)+int64(hdrLen+4); got != want {
+			t.Fatalf("expected merged segment size %d, got %d", want, got)
+		}
+
+		if _, ok := db.tombstones.get("k1"); !ok {
+			t.Fatalf("expected tombstone of k1 to be tracked after merge")
+		}
+
+		_ = db.Close()
+
+		reopened, err := Open(dir, opts...)
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		defer reopened.Close() // nolint:errcheck
+
+		if _, err := reopened.Get("k1"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expected k1 to stay deleted after reopen, got %v", err)
+		}
+		if v, err := reopened.Get("k2"); err != nil || v != "v2" {
+			t.Fatalf("expected k2=v2, got %q, %v", v, err)
+		}
+		if v, err := reopened.Get("k3"); err != nil || v != "v3" {
+			t.Fatalf("expected k3=v3, got %q, %v", v, err)
+		}
+	})
+}
+
+// TestPartialMergesThenFullMergeDropsTombstones runs a partial merge that keeps
+// a tombstone, then a full merge which proves it obsolete and drops it.
+func TestPartialMergesThenFullMergeDropsTombstones(t *testing.T) {
+	synctest.Run(func() {
+		db, dir, _ := SetupTempDB(t,
+			WithRolloverThreshold(30),
+			WithMergeThreshold(2),
+			WithMergeMaxSegments(1),
+			WithMergeEnabled(true),
+		)
+
+		_ = db.Set("k1", "v1")
+		_ = db.Set("k2", "v2") // seg001 rollover
+		_ = db.Delete("k1")
+		_ = db.Set("k3", "v3") // seg002 rollover, partial merge keeps the tombstone
+		synctest.Wait()
+
+		if _, ok := db.tombstones.get("k1"); !ok {
+			t.Fatalf("expected tombstone of k1 to survive the partial merge")
+		}
+
+		// now merge everything, nothing is older than the merged range
+		db.mergeMaxSegments = 0
+		if err := db.merge(); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+
+		if _, ok := db.tombstones.get("k1"); ok {
+			t.Fatalf("expected tombstone of k1 to be dropped by the full merge")
+		}
+
+		// only k2 and k3 are left in the merged segment
+		if got, want := db.segments[0].dataSize(), int64(2*(hdrLen+4)); got != want {
+			t.Fatalf("expected merged segment size %d, got %d", want, got)
+		}
+
+		_ = db.Close()
+
+		reopened, err := Open(dir, WithMergeEnabled(false))
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		defer reopened.Close() // nolint:errcheck
+
+		if _, err := reopened.Get("k1"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expected k1 to stay deleted after reopen, got %v", err)
+		}
+		if v, err := reopened.Get("k2"); err != nil || v != "v2" {
+			t.Fatalf("expected k2=v2, got %q, %v", v, err)
+		}
+	})
+}
+
+// TestMergeWithMmapReads checks that merge output gets mapped and the
+// replaced segments are unmapped, while Gets keep going.
+func TestMergeWithMmapReads(t *testing.T) {
+	synctest.Run(func() {
+		db, _, _ := SetupTempDB(t,
+			WithRolloverThreshold(30),
+			WithMergeThreshold(3),
+			WithMergeEnabled(true),
+			WithMmapReads(true),
+		)
+
+		// 3 rollovers, the last one triggers the merge
+		for i := 0; i < 6; i++ {
+			_ = db.Set(fmt.Sprintf("k%d", i%2), fmt.Sprintf("v%d", i))
+		}
+
+		db.rw.RLock()
+		old := append([]*segment(nil), db.segments[:len(db.segments)-1]...)
+		db.rw.RUnlock()
+
+		// read while the merge goroutine runs
+		for i := 0; i < 100; i++ {
+			if v, err := db.Get("k1"); err != nil || v != "v5" {
+				t.Fatalf("expected k1=v5, got %q, %v", v, err)
+			}
+		}
+
+		synctest.Wait()
+
+		for _, seg := range old {
+			if seg.data != nil {
+				t.Fatalf("replaced segment %d is still mapped", seg.id)
+			}
+		}
+		for _, seg := range db.segments[:len(db.segments)-1] {
+			if seg.data == nil {
+				t.Fatalf("merged segment %d is not mapped", seg.id)
+			}
+			if seg.hdr.flags&segFlagMerged == 0 || seg.generation != 1 {
+				t.Fatalf("merged segment %d: unexpected flags %d, generation %d", seg.id, seg.hdr.flags, seg.generation)
+			}
+		}
+
+		if v, err := db.Get("k0"); err != nil || v != "v4" {
+			t.Fatalf("expected k0=v4, got %q, %v", v, err)
+		}
+	})
+}
+
+// TestMergeMovesCachedValues checks that cached values follow their records
+// to the merge output, so hot keys stay cached after a merge.
+func TestMergeMovesCachedValues(t *testing.T) {
+	synctest.Run(func() {
+		db, _, _ := SetupTempDB(t,
+			WithRolloverThreshold(30),
+			WithMergeThreshold(2),
+			WithMergeEnabled(true),
+			WithValueCache(1024),
+		)
+
+		_ = db.Set("k1", "v1")
+		_ = db.Set("k2", "v2") // rollover
+		if v, err := db.Get("k1"); err != nil || v != "v1" {
+			t.Fatalf("expected k1=v1, got %q, %v", v, err)
+		}
+
+		locBefore, _ := db.index.get("k1")
+
+		_ = db.Set("k3", "v3")
+		_ = db.Set("k4", "v4") // rollover, triggers merge
+		synctest.Wait()
+
+		if locAfter, _ := db.index.get("k1"); locAfter == locBefore {
+			t.Fatalf("expected k1 to be relocated by merge")
+		}
+
+		before := db.Stats()
+		if v, err := db.Get("k1"); err != nil || v != "v1" {
+			t.Fatalf("expected k1=v1 after merge, got %q, %v", v, err)
+		}
+		if after := db.Stats(); after.CacheHits != before.CacheHits+1 {
+			t.Fatalf("expected a cache hit after merge, stats before %+v, after %+v", before, after)
+		}
+	})
+}
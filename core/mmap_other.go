@@ -0,0 +1,18 @@
+//go:build !unix
+
+package core
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+func mmapFile(_ *os.File, _ int, _ bool) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(_ []byte) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of f into memory. Writable mappings are
+// shared, so the writes go to the file and the pages can be evicted by the OS.
+func mmapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	if b == nil {
+		return nil
+	}
+	return syscall.Munmap(b)
+}
@@ -0,0 +1,309 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+var ErrSegmentOrderUnknown = errors.New("segment order unknown")
+
+// RepairOptions changes how Repair handles a damaged database
+type RepairOptions struct {
+	// GuessOrder makes Repair guess the order of the segments when the
+	// MANIFEST can't be read, instead of failing with ErrSegmentOrderUnknown.
+	// Segments written by merges are replayed first, then the others, each
+	// in id order. That's the right order after full merges, but segments
+	// kept out of partial merges (WithMergeMaxSegments) end up after merge
+	// outputs they predate, and outputs of crashed merges are replayed too,
+	// so stale values can win.
+	GuessOrder bool
+}
+
+// RepairReport summarizes what Repair salvaged
+type RepairReport struct {
+	Segments     int          // segments read from the input directory
+	Recovered    int64        // records copied to the output directory
+	Lost         []Corruption // corrupted regions left out, each one lost at least one record
+	LostBytes    int64        // total size of the lost regions
+	TornBytes    int64        // record cut short at the end of the active segment, a write that was never acknowledged
+	GuessedOrder bool         // the MANIFEST was unusable, segments were replayed in a guessed order
+}
+
+// Repair salvages the records of the database in src into dst, which must not
+// exist or be empty. Every record is verified, valid records are copied in the
+// order they were written and corrupted bytes are skipped by resynchronizing
+// to the next valid record. dst gets clean segments and a fresh MANIFEST,
+// merge outputs keep their merged flag and generation.
+//
+// src is only read, and the database must not be open while it's repaired.
+func Repair(src, dst string, opts RepairOptions) (*RepairReport, error) {
+	files, err := listSegmentFiles(src)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &RepairReport{}
+
+	srcs, err := repairSegmentOrder(src, files, opts, rep)
+	if err != nil {
+		return nil, err
+	}
+	rep.Segments = len(srcs)
+
+	if err := createEmptyDir(dst); err != nil {
+		return nil, err
+	}
+
+	var out []*segment
+	defer func() {
+		for _, seg := range out {
+			if err := seg.close(); err != nil {
+				log.Printf("close segment %d: %v", seg.id, err)
+			}
+		}
+	}()
+
+	for i, m := range srcs {
+		id := m.id
+		name, ok := files[id]
+		if !ok {
+			log.Printf("repair: segment %d is missing", id)
+			rep.Lost = append(rep.Lost, Corruption{Segment: id, Err: os.ErrNotExist})
+			continue
+		}
+
+		isActive := i == len(srcs)-1
+		seg, err := salvageSegment(filepath.Join(src, name), m, isActive, dst, len(out)+1, rep)
+		if err != nil {
+			return nil, fmt.Errorf("salvage segment %d: %w", id, err)
+		}
+		if seg != nil {
+			out = append(out, seg)
+		}
+	}
+
+	metas := make([]segmentMeta, len(out))
+	for i, seg := range out {
+		if err := seg.file.Sync(); err != nil {
+			return nil, fmt.Errorf("sync segment %d: %w", seg.id, err)
+		}
+
+		// merge outputs stay marked, WatchFrom doesn't replay them as writes
+		metas[i] = segmentMeta{id: seg.id, generation: seg.generation}
+		if seg.hdr.flags&segFlagMerged != 0 {
+			metas[i].flags = metaMerged
+		}
+		if isActive := i == len(out)-1; !isActive {
+			metas[i].size, metas[i].records = seg.size, seg.records
+			metas[i].flags |= metaSealed
+		}
+	}
+
+	if err := replaceFileAtomic(filepath.Join(dst, manifestName), encodeManifestSnapshot(metas)); err != nil {
+		return nil, fmt.Errorf("write manifest: %w", err)
+	}
+
+	return rep, nil
+}
+
+// listSegmentFiles returns the names of the segment files in dir by id
+func listSegmentFiles(dir string) (map[int]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	files := make(map[int]string)
+	for _, entry := range entries {
+		id, legacy, ok := parseSegmentName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		// a segment renamed halfway through the migration has both names
+		if _, dup := files[id]; dup && legacy {
+			continue
+		}
+		files[id] = entry.Name()
+	}
+
+	return files, nil
+}
+
+// repairSegmentOrder returns the segments of dir in replay order. It's the
+// MANIFEST order, or a guess with opts.GuessOrder if the MANIFEST can't be
+// read, then merge outputs are generation 1.
+func repairSegmentOrder(dir string, files map[int]string, opts RepairOptions, rep *RepairReport) ([]segmentMeta, error) {
+	st, err := readManifest(filepath.Join(dir, manifestName))
+	if err == nil && len(st.segs) > 0 {
+		return st.segs, nil
+	}
+	if err == nil {
+		err = errors.New("no segments")
+	}
+
+	if !opts.GuessOrder {
+		return nil, fmt.Errorf("%w: manifest is unusable: %w", ErrSegmentOrderUnknown, err)
+	}
+
+	log.Printf("repair: manifest is unusable (%v), guessing the segment order", err)
+	rep.GuessedOrder = true
+
+	// merge outputs hold older data than the segments written after them
+	merged := make(map[int]bool)
+	for id, name := range files {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("open segment %d: %w", id, err)
+		}
+		hdr, err := readSegmentHeader(f)
+		_ = f.Close()
+		if err != nil && !errors.Is(err, ErrBadSegmentHeader) {
+			return nil, fmt.Errorf("segment %d: %w", id, err)
+		}
+		merged[id] = hdr.flags&segFlagMerged != 0
+	}
+
+	ids := slices.Collect(maps.Keys(files))
+	slices.SortFunc(ids, func(a, b int) int {
+		if merged[a] != merged[b] {
+			if merged[a] {
+				return -1
+			}
+			return 1
+		}
+		return a - b
+	})
+
+	metas := make([]segmentMeta, len(ids))
+	for i, id := range ids {
+		metas[i] = segmentMeta{id: id}
+		if merged[id] {
+			metas[i].generation, metas[i].flags = 1, metaMerged
+		}
+	}
+	return metas, nil
+}
+
+// createEmptyDir creates dir, which is fine to exist if it's empty
+func createEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read dir: %w", err)
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("output directory %q is not empty", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir %q: %w", dir, err)
+	}
+
+	return nil
+}
+
+// salvageSegment copies the valid records of segment src at path to a new segment
+// with newId in dst, merged like src. It returns nil if the segment has no valid records.
+func salvageSegment(path string, src segmentMeta, isActive bool, dst string, newId int, rep *RepairReport) (rseg *segment, rerr error) {
+	id := src.id
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open segment file %q: %w", path, err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat segment file %q: %w", path, err)
+	}
+	size := info.Size()
+
+	var out *segment
+	defer func() {
+		if rerr != nil && out != nil {
+			_ = out.close()
+		}
+	}()
+
+	lose := func(off, next int64, err error) {
+		log.Printf("repair: segment %d: lost bytes [%d, %d): %v", id, off, next, err)
+		rep.Lost = append(rep.Lost, Corruption{Segment: id, Offset: off, Length: next - off, Err: err})
+		rep.LostBytes += next - off
+	}
+
+	var off int64
+	hdr, err := readSegmentHeader(f)
+	switch {
+	case errors.Is(err, ErrBadSegmentHeader):
+		if off, err = findNextRecord(f, 0, size); err != nil {
+			return nil, err
+		}
+		lose(0, off, ErrBadSegmentHeader)
+	case err != nil:
+		return nil, err
+	default:
+		off = hdr.len()
+	}
+
+	// a merge output without a known generation is at least the first one
+	var flags uint8
+	gen := src.generation
+	if src.flags&metaMerged != 0 || hdr.flags&segFlagMerged != 0 {
+		flags, gen = segFlagMerged, max(gen, 1)
+	}
+
+	for off < size {
+		rs := newRecordScannerRange(f, off, size, true)
+		for rs.scan() {
+			if out == nil {
+				if out, err = newSegment(dst, newId, flags); err != nil {
+					return nil, err
+				}
+				out.generation = gen
+			}
+
+			if _, err := out.writeRaw(rs.raw(), false); err != nil {
+				return nil, err
+			}
+			rep.Recovered++
+		}
+
+		lostAt, cerr := rs.end, rs.err
+		switch {
+		case rs.err == nil && rs.end == size:
+			return out, nil
+		case errors.Is(rs.err, ErrChecksumMismatch):
+			lostAt = rs.off
+		case rs.err == nil:
+			cerr = fmt.Errorf("truncated record at %d", rs.end)
+		case !errors.Is(rs.err, errRecordOutOfRange):
+			return nil, rs.err
+		}
+
+		next, err := findNextRecord(f, lostAt, size)
+		if err != nil {
+			return nil, err
+		}
+
+		// a record cut short at the end of the active segment is a torn
+		// write, Open truncates it without reporting a corruption
+		cutShort := rs.err == nil || errors.Is(rs.err, errRecordOutOfRange)
+		if isActive && cutShort && next == size {
+			log.Printf("repair: segment %d: torn write of %d bytes at %d", id, size-lostAt, lostAt)
+			rep.TornBytes += size - lostAt
+			return out, nil
+		}
+
+		lose(lostAt, next, cerr)
+		off = next
+	}
+
+	return out, nil
+}
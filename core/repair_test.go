@@ -0,0 +1,204 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readDir returns the contents of the files in dir by name
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	entries, _ := os.ReadDir(dir)
+	files := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+		files[e.Name()] = string(data)
+	}
+	return files
+}
+
+func TestRepair(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(100), WithMergeEnabled(false))
+	for i := range 20 {
+		_ = db.Set(fmt.Sprintf("k%02d", i), "value")
+	}
+	_ = db.Set("k00", "new")
+	_ = db.Delete("k01")
+	loc, _ := db.index.get("k05")
+	_ = db.Close()
+
+	corruptAt(t, getSegmentPath(dir, int(loc.segId)), loc.offset+hdrLen+3)
+	before := readDir(t, dir)
+
+	out := filepath.Join(t.TempDir(), "out")
+	rep, err := Repair(dir, out, RepairOptions{})
+	if err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+
+	if len(rep.Lost) != 1 || rep.Lost[0].Segment != int(loc.segId) || rep.Lost[0].Offset != loc.offset ||
+		!errors.Is(rep.Lost[0].Err, ErrChecksumMismatch) {
+		t.Fatalf("unexpected lost regions: %+v", rep.Lost)
+	}
+	if rep.Recovered != 20+2-1 {
+		t.Fatalf("expected 21 recovered records, got %d", rep.Recovered)
+	}
+
+	if after := readDir(t, dir); len(after) != len(before) {
+		t.Fatalf("input directory changed")
+	} else {
+		for name, data := range before {
+			if after[name] != data {
+				t.Fatalf("input file %s changed", name)
+			}
+		}
+	}
+
+	db2, err := Open(out, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open repaired: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if st := db2.Stats(); st.Keys != 18 {
+		t.Fatalf("expected 18 keys, got %d", st.Keys)
+	}
+	if v, err := db2.Get("k00"); err != nil || v != "new" {
+		t.Fatalf("expected k00=new, got %q, %v", v, err)
+	}
+	for _, k := range []string{"k01", "k05"} {
+		if _, err := db2.Get(k); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expected %s to be missing, got %v", k, err)
+		}
+	}
+	if found, err := db2.Scrub(); err != nil || len(found) != 0 {
+		t.Fatalf("expected clean segments, got %+v, %v", found, err)
+	}
+
+	// the output must be empty
+	if _, err := Repair(dir, out, RepairOptions{}); err == nil {
+		t.Fatalf("expected repair into a non-empty directory to fail")
+	}
+}
+
+func TestRepairWithoutManifest(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Set("a", "2")
+
+	// the merge output gets a higher id than the active segment it precedes
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	_ = db.Set("a", "3")
+	_ = db.Close()
+
+	_ = os.Remove(filepath.Join(dir, manifestName))
+
+	out := filepath.Join(t.TempDir(), "out")
+	if _, err := Repair(dir, out, RepairOptions{}); !errors.Is(err, ErrSegmentOrderUnknown) {
+		t.Fatalf("expected the segment order to be unknown, got %v", err)
+	}
+
+	rep, err := Repair(dir, out, RepairOptions{GuessOrder: true})
+	if err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if !rep.GuessedOrder {
+		t.Fatalf("expected the report to say the order was guessed")
+	}
+
+	db2, err := Open(out, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open repaired: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if v, err := db2.Get("a"); err != nil || v != "3" {
+		t.Fatalf("expected a=3, got %q, %v", v, err)
+	}
+}
+
+func TestRepairKeepsMerged(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Set("a", "2")
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	_ = db.Set("b", "3")
+	_ = db.Close()
+
+	src, _ := readManifest(filepath.Join(dir, manifestName))
+
+	out := filepath.Join(t.TempDir(), "out")
+	if _, err := Repair(dir, out, RepairOptions{}); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+
+	mnf, err := readManifest(filepath.Join(out, manifestName))
+	if err != nil {
+		t.Fatalf("read repaired manifest: %v", err)
+	}
+	if m := mnf.segs[0]; m.flags&metaMerged == 0 || m.generation != src.segs[0].generation {
+		t.Fatalf("expected the merge output to stay merged, got %+v, source %+v", m, src.segs[0])
+	}
+
+	db2, err := Open(out, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open repaired: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if db2.segments[0].hdr.flags&segFlagMerged == 0 {
+		t.Fatalf("expected the merged flag in the segment header")
+	}
+
+	// the merged history isn't replayed as writes
+	w, err := db2.WatchFrom(context.Background(), "", Seq{})
+	if err != nil {
+		t.Fatalf("watch from the start: %v", err)
+	}
+	if got := eventString(nextEvents(t, w, 1)); got != "set b=3;" {
+		t.Fatalf("expected set b=3;, got %s", got)
+	}
+}
+
+func TestRepairTornWrite(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false))
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "2")
+	loc, _ := db.index.get("b")
+	_ = db.Close()
+
+	// cut the last record short, as a crash in the middle of the write does
+	path := getSegmentPath(dir, int(loc.segId))
+	_ = os.Truncate(path, loc.offset+hdrLen)
+
+	rep, err := Repair(dir, filepath.Join(t.TempDir(), "out"), RepairOptions{})
+	if err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if len(rep.Lost) != 0 || rep.TornBytes != hdrLen || rep.Recovered != 1 {
+		t.Fatalf("expected a torn write and no lost regions, got %+v", rep)
+	}
+}
+
+// corruptAt flips a byte of the file at path
+func corruptAt(t *testing.T, path string, off int64) {
+	t.Helper()
+
+	f, _ := os.OpenFile(path, os.O_RDWR, 0o644)
+	b := make([]byte, 1)
+	_, _ = f.ReadAt(b, off)
+	_, _ = f.WriteAt([]byte{^b[0]}, off)
+	_ = f.Close()
+}
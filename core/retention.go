@@ -0,0 +1,335 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// With a retention window, segments that are merged away are moved to the
+// archive directory instead of being removed, and kept there for the window.
+// The HISTORY file in it lists the merges, so the segment list of any point in
+// the window can be reconstructed: starting from the MANIFEST, the merges done
+// after that point are undone, newest first, by putting their inputs back in
+// place of their outputs.
+const archiveDirName = "archive"
+
+const historyName = "HISTORY"
+
+var ErrNotRetained = errors.New("point in time not retained")
+
+// WithRetention keeps merged-away segments in the archive
+// directory for d, so RestoreAt can go back as far as d.
+func WithRetention(d time.Duration) Option {
+	return func(db *DB) { db.retention = d }
+}
+
+// history is the content of the HISTORY file
+type history struct {
+	Since  time.Time      `json:"since"`  // points since then can be restored
+	Merges []historyMerge `json:"merges"` // oldest first
+}
+
+// historyMerge is a merge, it replaced the Removed segments with the Added ones
+type historyMerge struct {
+	Time    time.Time `json:"time"`
+	Removed []int     `json:"removed"` // manifest order
+	Added   []int     `json:"added"`
+}
+
+func readHistory(dir string) (*history, error) {
+	data, err := os.ReadFile(filepath.Join(dir, archiveDirName, historyName))
+	if err != nil {
+		return nil, err
+	}
+
+	var h history
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("decode history: %w", err)
+	}
+	return &h, nil
+}
+
+// loadHistory reads the history, or starts it when retention is first enabled
+func (db *DB) loadHistory() error {
+	if err := os.MkdirAll(filepath.Join(db.dir, archiveDirName), 0o755); err != nil {
+		return fmt.Errorf("create archive dir: %w", err)
+	}
+
+	h, err := readHistory(db.dir)
+	if os.IsNotExist(err) {
+		h, err = &history{Since: time.Now()}, nil
+	}
+	if err != nil {
+		return err
+	}
+	db.history = h
+
+	return db.pruneArchive(time.Now())
+}
+
+// recordMerge adds a merge to the history and prunes the archive.
+// Caller must hold the db lock.
+func (db *DB) recordMerge(removed, added []*segment) error {
+	m := historyMerge{Time: time.Now()}
+	for _, seg := range removed {
+		m.Removed = append(m.Removed, seg.id)
+	}
+	for _, seg := range added {
+		m.Added = append(m.Added, seg.id)
+	}
+	db.history.Merges = append(db.history.Merges, m)
+
+	return db.pruneArchive(m.Time)
+}
+
+// pruneArchive drops the merges and the archived segments that are older than
+// the retention window, and writes the history. Caller must hold the db lock.
+func (db *DB) pruneArchive(now time.Time) error {
+	h := db.history
+
+	cutoff := now.Add(-db.retention)
+	if h.Since.Before(cutoff) {
+		h.Since = cutoff
+	}
+
+	// merges before since are never undone
+	i := 0
+	for i < len(h.Merges) && h.Merges[i].Time.Before(h.Since) {
+		i++
+	}
+	h.Merges = h.Merges[i:]
+
+	// archived segments are only needed to undo the merges left
+	needed := make(map[int]bool)
+	for _, m := range h.Merges {
+		for _, id := range m.Removed {
+			needed[id] = true
+		}
+	}
+
+	adir := filepath.Join(db.dir, archiveDirName)
+	files, err := listSegmentFiles(adir)
+	if err != nil {
+		return err
+	}
+	for id, name := range files {
+		if needed[id] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(adir, name)); err != nil {
+			log.Printf("remove archived segment %d: %v", id, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode history: %w", err)
+	}
+	return replaceFileAtomic(filepath.Join(adir, historyName), data)
+}
+
+// dropSegmentFile moves the file of a merged-away segment to the archive
+// with a retention window, or removes it otherwise
+func (db *DB) dropSegmentFile(id int) {
+	path := getSegmentPath(db.dir, id)
+
+	if db.retention > 0 {
+		if err := os.Rename(path, getSegmentPath(filepath.Join(db.dir, archiveDirName), id)); err != nil {
+			log.Printf("archive old segment %d: %v", id, err)
+		}
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Printf("remove old segment %d: %v", id, err)
+	}
+}
+
+// RestoreAt reconstructs the database in dir as of t into dest, which must not
+// exist or be empty. dir must have a retention window that covers t, and it
+// shouldn't be open meanwhile. The segment that was active at t is cut at the
+// first record written after t, for which records need WithTimestamps. Without
+// them, the state is restored as of the end of that segment: writes that went
+// to it after t are restored too.
+func RestoreAt(dir, dest string, t time.Time) error {
+	h, err := readHistory(dir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: no retention history in %s", ErrNotRetained, dir)
+	}
+	if err != nil {
+		return err
+	}
+	if t.Before(h.Since) {
+		return fmt.Errorf("%w: %s is before the oldest retained point %s", ErrNotRetained, t.Format(time.RFC3339Nano), h.Since.Format(time.RFC3339Nano))
+	}
+
+	st, err := readManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		return err
+	}
+
+	// the segment list at t
+	ids := st.ids()
+	for i := len(h.Merges) - 1; i >= 0 && h.Merges[i].Time.After(t); i-- {
+		if ids, err = undoMerge(ids, h.Merges[i]); err != nil {
+			return err
+		}
+	}
+
+	paths, err := restoreAtPaths(dir, ids, t)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("%w: no segments as of %s", ErrNotRetained, t.Format(time.RFC3339Nano))
+	}
+
+	if err := createEmptyDir(dest); err != nil {
+		return err
+	}
+
+	metas := make([]segmentMeta, len(paths))
+	for i, path := range paths {
+		id := ids[i]
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		// the active segment is copied, so writes to dest don't reach the original
+		isActive := i == len(paths)-1
+		if isActive {
+			err = copyFile(path, getSegmentPath(dest, id), 0, info.Size())
+			if err == nil {
+				err = truncateAfter(getSegmentPath(dest, id), t)
+			}
+		} else {
+			err = linkOrCopyFile(path, getSegmentPath(dest, id), info.Size())
+		}
+		if err != nil {
+			return fmt.Errorf("restore segment %d: %w", id, err)
+		}
+
+		if metas[i], err = restoredSegmentMeta(dest, id, !isActive); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceFileAtomic(filepath.Join(dest, manifestName), encodeManifestSnapshot(metas)); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// undoMerge puts the inputs of merge m back in place of its outputs in ids
+func undoMerge(ids []int, m historyMerge) ([]int, error) {
+	i := slices.Index(ids, m.Added[0])
+	if i < 0 || len(ids) < i+len(m.Added) || !slices.Equal(ids[i:i+len(m.Added)], m.Added) {
+		return nil, fmt.Errorf("%w: outputs %v of the merge at %s aren't in the segment list",
+			ErrNotRetained, m.Added, m.Time.Format(time.RFC3339Nano))
+	}
+
+	return slices.Concat(ids[:i], m.Removed, ids[i+len(m.Added):]), nil
+}
+
+// restoreAtPaths locates the files of ids, live or archived, up to the
+// last segment created before t. ids after it didn't exist at t.
+func restoreAtPaths(dir string, ids []int, t time.Time) ([]string, error) {
+	var paths []string
+	for _, id := range ids {
+		path := getSegmentPath(dir, id)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = getSegmentPath(filepath.Join(dir, archiveDirName), id)
+		}
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: segment %d was pruned", ErrNotRetained, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hdr, err := readSegmentHeader(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", id, err)
+		}
+
+		if hdr.createdAt.After(t) {
+			break
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// restoredSegmentMeta scans a restored segment to describe it for the manifest.
+// Inactive segments are links to the live or archived files, so it only reads.
+func restoredSegmentMeta(dir string, id int, sealed bool) (segmentMeta, error) {
+	f, err := os.Open(getSegmentPath(dir, id))
+	if err != nil {
+		return segmentMeta{}, fmt.Errorf("restore segment %d: %w", id, err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	hdr, err := readSegmentHeader(f)
+	if err != nil {
+		return segmentMeta{}, fmt.Errorf("restore segment %d: %w", id, err)
+	}
+
+	var records int64
+	rs := newRecordScannerAt(f, hdr.len(), true)
+	for rs.scan() {
+		records++
+	}
+	if rs.err != nil {
+		return segmentMeta{}, fmt.Errorf("restore segment %d: %w", id, rs.err)
+	}
+
+	m := segmentMeta{id: id}
+	if hdr.flags&segFlagMerged != 0 {
+		m.generation, m.flags = 1, metaMerged
+	}
+	if sealed {
+		m.size, m.records = rs.end, records
+		m.flags |= metaSealed
+	}
+	return m, nil
+}
+
+// truncateAfter cuts the segment at path at its first record written after t
+func truncateAfter(path string, t time.Time) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	hdr, err := readSegmentHeader(f)
+	if err != nil {
+		return err
+	}
+
+	rs := newRecordScannerAt(f, hdr.len(), false)
+	for rs.scanHeader() {
+		if !rs.readValue() {
+			break
+		}
+
+		if _, ts, err := splitValue(rs.raw(), len(rs.key)); err == nil && ts.After(t) {
+			if err := f.Truncate(rs.off); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+	}
+
+	return rs.err
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreAt(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false), WithRetention(time.Hour))
+	start := time.Now()
+
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "1")
+
+	time.Sleep(time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// goes to the segment that was active at t1, so it's restored too
+	_ = db.Set("filler", "x")
+	_ = db.Set("a", "2")
+	_ = db.Delete("b")
+
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if files, _ := listSegmentFiles(filepath.Join(dir, archiveDirName)); len(files) == 0 {
+		t.Fatalf("expected merged segments in the archive")
+	}
+
+	_ = db.Set("c", "3")
+	t2 := time.Now()
+	_ = db.Close()
+
+	restore := func(at time.Time) *DB {
+		dest := filepath.Join(t.TempDir(), "restored")
+		if err := RestoreAt(dir, dest, at); err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+
+		db, err := Open(dest, WithMergeEnabled(false))
+		if err != nil {
+			t.Fatalf("open restored: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	}
+
+	for at, want := range map[time.Time]map[string]string{
+		t1: {"a": "1", "b": "1", "filler": "x"},
+		t2: {"a": "2", "filler": "x", "c": "3"},
+	} {
+		db := restore(at)
+		if st := db.Stats(); st.Keys != len(want) {
+			t.Fatalf("expected %d keys as of %v, got %d", len(want), at, st.Keys)
+		}
+		for key, val := range want {
+			if v, err := db.Get(key); err != nil || v != val {
+				t.Fatalf("expected %s=%s as of %v, got %q, %v", key, val, at, v, err)
+			}
+		}
+	}
+
+	// restored segments are links, restoring only reads them
+	archived := getSegmentPath(filepath.Join(dir, archiveDirName), 1)
+	f, _ := os.OpenFile(archived, os.O_WRONLY|os.O_APPEND, 0o644)
+	_, _ = f.Write([]byte{1, 2, 3})
+	_ = f.Close()
+	before, _ := os.Stat(archived)
+	if err := RestoreAt(dir, filepath.Join(t.TempDir(), "links"), t1); err != nil {
+		t.Fatalf("restore with a torn archived segment: %v", err)
+	}
+	if after, err := os.Stat(archived); err != nil || after.Size() != before.Size() {
+		t.Fatalf("expected the archived segment to stay %d bytes, got %v, %v", before.Size(), after, err)
+	}
+
+	err := RestoreAt(dir, filepath.Join(t.TempDir(), "early"), start.Add(-time.Minute))
+	if !errors.Is(err, ErrNotRetained) {
+		t.Fatalf("expected a point before retention to fail, got %v", err)
+	}
+}
+
+func TestRetentionPrune(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false), WithRetention(time.Nanosecond))
+	_ = db.Set("a", "1")
+	_ = db.Set("a", "2")
+
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+
+	// the window is over right after the merge
+	time.Sleep(time.Millisecond)
+	db.rw.Lock()
+	err := db.pruneArchive(time.Now())
+	db.rw.Unlock()
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	if files, _ := listSegmentFiles(filepath.Join(dir, archiveDirName)); len(files) != 0 {
+		t.Fatalf("expected the archive to be pruned, got %v", files)
+	}
+	if len(db.history.Merges) != 0 {
+		t.Fatalf("expected the history to be pruned, got %+v", db.history.Merges)
+	}
+}
+
+func TestRestoreAtTimestamps(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithMergeEnabled(false), WithRetention(time.Hour), WithTimestamps(true))
+	_ = db.Set("a", "1")
+
+	time.Sleep(time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// same segment, it's cut at t1
+	_ = db.Set("a", "2")
+	_ = db.Set("b", "2")
+	_ = db.Close()
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreAt(dir, dest, t1); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	db2, err := Open(dest, WithMergeEnabled(false))
+	if err != nil {
+		t.Fatalf("open restored: %v", err)
+	}
+	defer db2.Close() // nolint:errcheck
+
+	if v, err := db2.Get("a"); err != nil || v != "1" {
+		t.Fatalf("expected a=1, got %q, %v", v, err)
+	}
+	if _, err := db2.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected b to be written after t1, got %v", err)
+	}
+}
+
+func TestRetentionStaleHistoryTemp(t *testing.T) {
+	db, dir, _ := SetupTempDB(t, WithRetention(time.Hour))
+	_ = db.Close()
+
+	// a crash while the history is written leaves its temp file behind
+	tmp := filepath.Join(dir, archiveDirName, historyName+tmpSuffix)
+	if err := os.WriteFile(tmp, []byte("{"), 0o644); err != nil {
+		t.Fatalf("write temp history: %v", err)
+	}
+
+	for range 2 {
+		db, err := Open(dir, WithRetention(time.Hour))
+		if err != nil {
+			t.Fatalf("open with a stale temp history: %v", err)
+		}
+		_ = db.Close()
+	}
+
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected the temp history to be removed, got %v", err)
+	}
+}
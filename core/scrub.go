@@ -0,0 +1,245 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// ErrKeyCorrupted is returned by Get for keys whose
+// latest record is found corrupted by the scrubber
+var ErrKeyCorrupted = errors.New("key corrupted")
+
+const defaultScrubRate = 8 * 1024 * 1024 // bytes per second
+
+// Corruption is a damaged record found in a segment
+type Corruption struct {
+	Segment int    // id of the segment
+	Offset  int64  // offset of the damaged record in the segment
+	Length  int64  // number of damaged bytes, up to the next valid record
+	Key     string // key of the record if it's the latest record of the key, empty otherwise
+	Err     error
+}
+
+// WithScrubInterval starts a background scrubber that re-reads the inactive
+// segments every d and verifies the checksums of their records. Corrupted
+// records are reported through the WithOnCorruption callback and stats.
+// 0 (the default) disables the scrubber.
+func WithScrubInterval(d time.Duration) Option {
+	return func(db *DB) { db.scrubInterval = d }
+}
+
+// WithScrubRate limits how many bytes per second the background scrubber reads.
+func WithScrubRate(bytesPerSec int64) Option {
+	return func(db *DB) { db.scrubRate = max(bytesPerSec, 1) }
+}
+
+// WithOnCorruption registers a callback for the corruptions found by the scrubber.
+// It's called from the scrubber goroutine, or from Scrub.
+func WithOnCorruption(f func(Corruption)) Option {
+	return func(db *DB) { db.onCorruption = f }
+}
+
+// WithScrubMarkKeys makes the scrubber mark the keys whose latest record is
+// corrupted, Get returns ErrKeyCorrupted for them until they are set or deleted.
+func WithScrubMarkKeys(b bool) Option {
+	return func(db *DB) { db.scrubMarkKeys = b }
+}
+
+// scrubStats are the counters of the scrubber
+type scrubStats struct {
+	passes      atomic.Int64
+	bytes       atomic.Int64
+	corruptions atomic.Int64
+}
+
+// Scrub verifies all inactive segments once, without throttling,
+// and returns the corruptions it found.
+func (db *DB) Scrub() ([]Corruption, error) {
+	return db.scrubPass(nil)
+}
+
+// CorruptKeys returns the keys marked as corrupted by the scrubber
+func (db *DB) CorruptKeys() []string {
+	db.rw.RLock()
+	defer db.rw.RUnlock()
+
+	keys := make([]string, 0, len(db.corruptKeys))
+	for key := range db.corruptKeys {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// startScrubber runs scrub passes every scrubInterval until stopScrubber is called
+func (db *DB) startScrubber() {
+	db.scrubStop = make(chan struct{})
+	db.scrubDone = make(chan struct{})
+
+	go func() {
+		defer close(db.scrubDone)
+
+		ticker := time.NewTicker(db.scrubInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-db.scrubStop:
+				return
+			case <-ticker.C:
+			}
+
+			if _, err := db.scrubPass(newThrottle(db.scrubRate, db.scrubStop)); err != nil {
+				if !errors.Is(err, errScrubStopped) {
+					log.Printf("scrub: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopScrubber stops the scrubber and waits for it to exit.
+// It must be called without holding the db lock.
+func (db *DB) stopScrubber() {
+	if db.scrubStop == nil {
+		return
+	}
+
+	db.scrubStopOnce.Do(func() { close(db.scrubStop) })
+	<-db.scrubDone
+}
+
+var errScrubStopped = errors.New("scrub stopped")
+
+// scrubPass verifies the records of the inactive segments. Segments closed
+// by a merge while they're scrubbed are skipped, their records are copied
+// to the merge output which is scrubbed on the next pass.
+func (db *DB) scrubPass(th *throttle) ([]Corruption, error) {
+	db.rw.RLock()
+	segs := slices.Clone(db.segments[:len(db.segments)-1])
+	db.rw.RUnlock()
+
+	var found []Corruption
+	for _, seg := range segs {
+		cs, err := db.scrubSegment(seg, th)
+		if errors.Is(err, fs.ErrClosed) {
+			continue
+		}
+		if err != nil {
+			return found, err
+		}
+
+		for _, c := range cs {
+			db.reportCorruption(seg, &c)
+			found = append(found, c)
+		}
+	}
+
+	db.scrubStats.passes.Add(1)
+	return found, nil
+}
+
+// scrubSegment scans the records of seg and collects the corrupted ones.
+// After a corrupted record it resumes at the next valid record.
+func (db *DB) scrubSegment(seg *segment, th *throttle) ([]Corruption, error) {
+	var found []Corruption
+
+	off := seg.hdr.len()
+	for off < seg.size {
+		rs := newRecordScannerRange(seg.file, off, seg.size, true)
+		for rs.scan() {
+			db.scrubStats.bytes.Add(rs.end - rs.record.off)
+			if err := th.wait(rs.end - rs.record.off); err != nil {
+				return found, err
+			}
+		}
+
+		c := Corruption{Segment: seg.id, Offset: rs.end, Err: rs.err}
+		switch {
+		case rs.err == nil && rs.end == seg.size:
+			return found, nil
+		case errors.Is(rs.err, ErrChecksumMismatch):
+			c.Offset, c.Key = rs.off, string(rs.key)
+		case rs.err == nil:
+			// sealed segments end with a complete record
+			c.Err = fmt.Errorf("truncated record at %d", rs.end)
+		case !errors.Is(rs.err, errRecordOutOfRange):
+			return nil, fmt.Errorf("scrub segment %d: %w", seg.id, rs.err)
+		}
+
+		next, err := findNextRecord(seg.file, c.Offset, seg.size)
+		if err != nil {
+			return nil, fmt.Errorf("scrub segment %d: %w", seg.id, err)
+		}
+
+		c.Length = next - c.Offset
+		found = append(found, c)
+		off = next
+	}
+
+	return found, nil
+}
+
+// reportCorruption resolves the key of c, marks it if enabled, and reports c
+func (db *DB) reportCorruption(seg *segment, c *Corruption) {
+	db.scrubStats.corruptions.Add(1)
+
+	db.rw.Lock()
+	// the key is only affected if this is its latest record
+	if loc, ok := db.index.get(c.Key); ok && c.Key != "" && loc.at(seg, c.Offset) {
+		if db.scrubMarkKeys {
+			db.corruptKeys[c.Key] = *c
+		}
+	} else {
+		c.Key = ""
+	}
+	db.rw.Unlock()
+
+	log.Printf("scrub: corrupted record in segment %d at %d: %v", c.Segment, c.Offset, c.Err)
+
+	if db.onCorruption != nil {
+		db.onCorruption(*c)
+	}
+}
+
+// throttle limits the read rate of the scrubber. A nil throttle doesn't wait.
+type throttle struct {
+	rate  int64 // bytes per second
+	start time.Time
+	bytes int64
+	stop  <-chan struct{}
+}
+
+func newThrottle(rate int64, stop <-chan struct{}) *throttle {
+	return &throttle{rate: rate, start: time.Now(), stop: stop}
+}
+
+// wait accounts for n bytes read and sleeps until the rate allows them
+func (th *throttle) wait(n int64) error {
+	if th == nil {
+		return nil
+	}
+
+	th.bytes += n
+	due := th.start.Add(time.Duration(float64(th.bytes) / float64(th.rate) * float64(time.Second)))
+
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-th.stop:
+		return errScrubStopped
+	}
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// corruptValue flips the first byte of the value of key's latest record
+func corruptValue(t *testing.T, db *DB, key string) {
+	t.Helper()
+
+	loc, _ := db.index.get(key)
+	f, _ := os.OpenFile(getSegmentPath(db.dir, int(loc.segId)), os.O_WRONLY, 0o644)
+	_, _ = f.WriteAt([]byte("X"), loc.offset+hdrLen+int64(len(key)))
+	_ = f.Close()
+}
+
+func TestScrub(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithMergeEnabled(false), WithScrubMarkKeys(true))
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		_ = db.Set(k, "value")
+	}
+	corruptValue(t, db, "b")
+	corruptValue(t, db, "d")
+	_ = db.rolloverSegment()
+
+	// the corrupted record of d is no longer its latest
+	_ = db.Set("d", "new")
+
+	found, err := db.Scrub()
+	if err != nil {
+		t.Fatalf("scrub: %v", err)
+	}
+	if len(found) != 2 || found[0].Key != "b" || found[1].Key != "" {
+		t.Fatalf("expected corruptions of b and the old d, got %+v", found)
+	}
+	for _, c := range found {
+		if !errors.Is(c.Err, ErrChecksumMismatch) {
+			t.Fatalf("expected checksum mismatch, got %v", c.Err)
+		}
+	}
+
+	if st := db.Stats(); st.ScrubPasses != 1 || st.ScrubCorruptions != 2 || st.ScrubBytes == 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	if got := db.CorruptKeys(); !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("expected b to be marked, got %v", got)
+	}
+	if _, err := db.Get("b"); !errors.Is(err, ErrKeyCorrupted) {
+		t.Fatalf("expected key corrupted, got %v", err)
+	}
+	for k, want := range map[string]string{"a": "value", "c": "value", "d": "new"} {
+		if v, err := db.Get(k); err != nil || v != want {
+			t.Fatalf("expected %s=%s, got %q, %v", k, want, v, err)
+		}
+	}
+
+	// a new value clears the mark
+	_ = db.Set("b", "fixed")
+	if v, err := db.Get("b"); err != nil || v != "fixed" {
+		t.Fatalf("expected b=fixed, got %q, %v", v, err)
+	}
+	if got := db.CorruptKeys(); len(got) != 0 {
+		t.Fatalf("expected no marked keys, got %v", got)
+	}
+}
+
+func TestScrubTruncatedSegment(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithMergeEnabled(false))
+	_ = db.Set("a", "value")
+	_ = db.Set("b", "value")
+	_ = db.rolloverSegment()
+
+	// the last record of the sealed segment is cut short
+	seg := db.segments[0]
+	_ = os.Truncate(getSegmentPath(db.dir, seg.id), seg.size-2)
+
+	found, err := db.Scrub()
+	if err != nil {
+		t.Fatalf("scrub: %v", err)
+	}
+	if len(found) != 1 || found[0].Segment != seg.id {
+		t.Fatalf("expected a corruption in segment %d, got %+v", seg.id, found)
+	}
+}
+
+func TestBackgroundScrubber(t *testing.T) {
+	found := make(chan Corruption, 1)
+	db, _, _ := SetupTempDB(t, WithMergeEnabled(false), WithScrubInterval(10*time.Millisecond),
+		WithOnCorruption(func(c Corruption) {
+			select {
+			case found <- c:
+			default:
+			}
+		}))
+
+	_ = db.Set("a", "value")
+	corruptValue(t, db, "a")
+
+	db.rw.Lock()
+	_ = db.rolloverSegment()
+	db.rw.Unlock()
+
+	select {
+	case c := <-found:
+		if c.Key != "a" || !errors.Is(c.Err, ErrChecksumMismatch) {
+			t.Fatalf("unexpected corruption: %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrubber didn't report the corruption")
+	}
+
+	// Close stops the scrubber
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,73 +10,219 @@ import (
 
 type segment struct {
 	id   int
-	file *os.File // open file handle for reading and writing records
-	size int64    // size of the segment file in bytes
+	file *os.File      // open file handle for reading and writing records
+	size int64         // size of the segment file in bytes, including the header
+	hdr  segmentHeader // zero for legacy segments
+
+	records    int64  // number of records in the segment
+	generation int    // merge generation, see segmentMeta
+	data       []byte // read-only mapping of the file once it's inactive, nil if not mapped
+
+	lost []Corruption // corrupted regions skipped on Open, in offset order
 }
 
-func newSegment(dir string, id int) (*segment, error) {
+// newSegment creates a segment file and writes its header
+func newSegment(dir string, id int, flags uint8) (*segment, error) {
 	path := getSegmentPath(dir, id)
 	f, err := os.Create(path)
 	if err != nil {
 		return nil, fmt.Errorf("create segment file %q: %w", path, err)
 	}
 
-	return &segment{id: id, file: f, size: 0}, nil
+	hdr := newSegmentHeader(flags)
+	n, err := f.Write(hdr.encode())
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("write header of segment %d: %w", id, err)
+	}
+
+	return &segment{id: id, file: f, size: int64(n), hdr: hdr}, nil
 }
 
-func parseSegment(dir string, id int, verifyChecksum bool) (rseg *segment, recs []*scannedRecord, rerr error) {
+// openSegment opens an existing segment and validates its header without
+// scanning the records. size is the known end of the segment, it's 0 for
+// segments that will be scanned.
+func openSegment(dir string, id int, size int64) (*segment, error) {
 	path := getSegmentPath(dir, id)
 	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
 	if err != nil {
-		return nil, nil, fmt.Errorf("open segment file %q: %w", path, err)
+		return nil, fmt.Errorf("open segment file %q: %w", path, err)
+	}
+
+	hdr, err := readSegmentHeader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("segment %d: %w", id, err)
+	}
+
+	if hdr.torn {
+		log.Printf("segment %d: header cut short, writing it again", id)
+		if err := rewriteSegmentHeader(f, hdr); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("segment %d: %w", id, err)
+		}
+		hdr.torn = false
 	}
 
-	seg := &segment{id: id, file: f}
+	// records start after the header
+	size = max(size, hdr.len())
+
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("seek on segment %d: %w", id, err)
+	}
+
+	return &segment{id: id, file: f, size: size, hdr: hdr}, nil
+}
+
+// dataSize returns the number of record bytes in the segment
+func (s *segment) dataSize() int64 {
+	return s.size - s.hdr.len()
+}
+
+// parseSegment opens the segment and scans all of its records.
+func parseSegment(dir string, id int, verifyChecksum, skipCorrupted bool) (rseg *segment, recs []*scannedRecord, rerr error) {
+	seg, err := openSegment(dir, id, 0)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	defer func() {
 		if rerr != nil {
-			if err := seg.file.Close(); err != nil {
+			if err := seg.close(); err != nil {
 				log.Printf("close segment %d: %v", seg.id, err)
 			}
 		}
 	}()
 
-	// collect the records from the current segment
-	rs := newRecordScanner(seg.file, verifyChecksum)
-	for rs.scan() {
-		recs = append(recs, rs.record)
+	if recs, err = seg.scan(verifyChecksum, skipCorrupted); err != nil {
+		return nil, nil, err
+	}
+
+	return seg, recs, nil
+}
+
+// scan collects the records of the segment starting at the current size,
+// which must be the end of the header or of an already known record. Size is updated
+// to the end of the last complete record and anything after it is truncated.
+//
+// With skipCorrupted, a corrupted record doesn't fail the scan. Scanning resumes
+// at the next valid record and the region in between is added to s.lost.
+func (s *segment) scan(verifyChecksum, skipCorrupted bool) ([]*scannedRecord, error) {
+	var recs []*scannedRecord
+
+	fileSize := int64(0)
+	if skipCorrupted {
+		info, err := s.file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("stat segment %d: %w", s.id, err)
+		}
+		fileSize = info.Size()
 	}
 
-	if err := rs.err; err != nil {
-		return nil, nil, fmt.Errorf("scan segment %d: %w", seg.id, err)
+	off := s.size
+	for {
+		// collect the records from the current segment
+		rs := newRecordScannerAt(s.file, off, verifyChecksum)
+		for rs.scan() {
+			recs = append(recs, rs.record)
+		}
+
+		off = rs.end
+		if !skipCorrupted || (rs.err != nil && !errors.Is(rs.err, ErrChecksumMismatch)) {
+			if err := rs.err; err != nil {
+				return nil, fmt.Errorf("scan segment %d: %w", s.id, err)
+			}
+			break
+		}
+
+		// a record cut short at the end is a torn write, unless there are
+		// valid records after it, then its header is corrupted
+		lostAt := off
+		if rs.err != nil {
+			lostAt = rs.off
+		}
+
+		next, err := findNextRecord(s.file, lostAt, fileSize)
+		if err != nil {
+			return nil, fmt.Errorf("scan segment %d: %w", s.id, err)
+		}
+
+		if rs.err == nil && next == fileSize {
+			break
+		}
+
+		cerr := rs.err
+		if cerr == nil {
+			cerr = fmt.Errorf("%w: record at %d", errRecordOutOfRange, lostAt)
+		}
+
+		log.Printf("warning: segment %d: skipping corrupted bytes [%d, %d): %v", s.id, lostAt, next, cerr)
+		s.lost = append(s.lost, Corruption{Segment: s.id, Offset: lostAt, Length: next - lostAt, Err: cerr})
+
+		// corrupted bytes up to the end of the file are kept, writes go after them
+		off = next
+		if off == fileSize {
+			break
+		}
 	}
 
 	// update segment size with the last correct offset
-	seg.size = rs.end
+	s.size = off
+	s.records += int64(len(recs))
 
 	// in case where we have a corrupted record,
 	// we truncate to the last "good" offset
-	if err := seg.file.Truncate(seg.size); err != nil {
-		return nil, nil, fmt.Errorf("truncate segment %d: %w", seg.id, err)
+	if err := s.file.Truncate(s.size); err != nil {
+		return nil, fmt.Errorf("truncate segment %d: %w", s.id, err)
 	}
 
 	// Go to the "new" end of the file in case it's truncated
-	if _, err := seg.file.Seek(0, io.SeekEnd); err != nil {
-		return nil, nil, fmt.Errorf("seek on truncated segment %d: %w", seg.id, err)
+	if _, err := s.file.Seek(0, io.SeekEnd); err != nil {
+		return nil, fmt.Errorf("seek on truncated segment %d: %w", s.id, err)
 	}
 
-	return seg, recs, nil
+	return recs, nil
 }
 
-// write writes record to the segment and returns the key offset
-func (s *segment) write(key string, val string, wt WriteType, fsync bool) (int64, error) {
+// write writes record to the segment and returns the key offset.
+// ts is the write time in unix nanos, 0 writes the record without one.
+func (s *segment) write(key string, val string, wt WriteType, ts int64, fsync bool) (int64, error) {
 	off := s.size
 
-	n, err := writeRecord(s.file, wt, key, val)
+	n, err := writeTimedRecord(s.file, wt, key, val, ts)
 	if err != nil {
 		return 0, fmt.Errorf("writeRecord on segment %d: %w", s.id, err)
 	}
+	s.records++
 
+	if err := s.advance(n, fsync); err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+// writeRaw appends an already encoded record to the segment and returns its offset.
+// It's used to copy records between segments without decoding and re-encoding them.
+func (s *segment) writeRaw(rec []byte, fsync bool) (int64, error) {
+	off := s.size
+
+	n, err := s.file.Write(rec)
+	if err != nil {
+		return 0, fmt.Errorf("write raw record on segment %d: %w", s.id, err)
+	}
+	s.records++
+
+	if err := s.advance(int64(n), fsync); err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+// advance accounts for n bytes appended to the segment
+func (s *segment) advance(n int64, fsync bool) error {
 	// increase file size by the written byte count
 	s.size += n
 
@@ -84,13 +231,42 @@ func (s *segment) write(key string, val string, wt WriteType, fsync bool) (int64
 		// fsync is crazy, it costs like 5ms. We could only accept this
 		// in group commit scenario.
 		if err := s.file.Sync(); err != nil {
-			return 0, fmt.Errorf("sync segment %d: %w", s.id, err)
+			return fmt.Errorf("sync segment %d: %w", s.id, err)
 		}
 	}
 
-	return off, nil
+	return nil
 }
 
 func (s *segment) read(off int64, verifyChecksum bool) (string, WriteType, error) {
+	if s.data != nil {
+		return decodeRecord(s.data, off, verifyChecksum)
+	}
 	return readRecord(s.file, off, verifyChecksum)
 }
+
+// mapForReads maps the segment into memory so reads don't need syscalls.
+// Only segments that won't be written anymore can be mapped. If mapping
+// fails, reads keep going to the file.
+func (s *segment) mapForReads() {
+	if s.data != nil {
+		return
+	}
+
+	data, err := mmapFile(s.file, int(s.size), false)
+	if err != nil {
+		log.Printf("mmap segment %d, reading from file instead: %v", s.id, err)
+		return
+	}
+
+	s.data = data
+}
+
+// close unmaps the segment if it's mapped and closes its file.
+// Caller must make sure no reads are in flight, which is
+// the case when the db lock is held.
+func (s *segment) close() error {
+	err := munmap(s.data)
+	s.data = nil
+	return errors.Join(err, s.file.Close())
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zeebo/xxh3"
+)
+
+// Segments start with a fixed size header that identifies the file and its format:
+//
+//	[8-byte magic][2-byte version][1-byte checksum algorithm][1-byte flags]
+//	[4-byte reserved][8-byte creation time, unix nanos][8-byte checksum of everything before]
+//
+// Records follow the header. Segments written before the header existed
+// start directly with a record, they are read as legacy segments.
+const segHdrLen = 32
+
+const segmentVersion = 1
+
+// checksumXXH3 is the only checksum algorithm records use for now
+const checksumXXH3 = 1
+
+// segment flags
+const (
+	segFlagMerged = 1 << iota // segment is written by merge
+)
+
+var segmentMagic = []byte("BITDBSEG")
+
+var ErrBadSegmentHeader = errors.New("bad segment header")
+
+// segmentHeader is the decoded header of a segment
+type segmentHeader struct {
+	version      uint16 // 0 for legacy segments without a header
+	checksumAlgo uint8
+	flags        uint8
+	createdAt    time.Time
+	torn         bool // cut short before any record was written, see readSegmentHeader
+}
+
+// len returns the number of bytes the header takes in the file
+func (h segmentHeader) len() int64 {
+	if h.version == 0 {
+		return 0
+	}
+	return segHdrLen
+}
+
+func newSegmentHeader(flags uint8) segmentHeader {
+	return segmentHeader{
+		version:      segmentVersion,
+		checksumAlgo: checksumXXH3,
+		flags:        flags,
+		createdAt:    time.Now(),
+	}
+}
+
+func (h segmentHeader) encode() []byte {
+	buf := make([]byte, 0, segHdrLen)
+	buf = append(buf, segmentMagic...)
+	buf = binary.LittleEndian.AppendUint16(buf, h.version)
+	buf = append(buf, h.checksumAlgo, h.flags)
+	buf = append(buf, 0, 0, 0, 0) // reserved
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.createdAt.UnixNano()))
+	return binary.LittleEndian.AppendUint64(buf, xxh3.Hash(buf))
+}
+
+// readSegmentHeader reads and validates the header at the start of r. Files
+// that don't start with the magic are legacy segments, they get a zero header.
+// A header cut short by a crash is a new segment without records, it gets a
+// fresh header marked torn, that openSegment writes again.
+func readSegmentHeader(r io.ReaderAt) (segmentHeader, error) {
+	var buf [segHdrLen]byte
+	n, err := r.ReadAt(buf[:], 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return segmentHeader{}, fmt.Errorf("read segment header: %w", err)
+	}
+
+	if n < segHdrLen {
+		if m := min(n, len(segmentMagic)); string(buf[:m]) == string(segmentMagic[:m]) {
+			h := newSegmentHeader(0)
+			h.torn = true
+			return h, nil
+		}
+		return segmentHeader{}, nil
+	}
+
+	if string(buf[:len(segmentMagic)]) != string(segmentMagic) {
+		return segmentHeader{}, nil
+	}
+
+	body, sum := buf[:segHdrLen-csLen], binary.LittleEndian.Uint64(buf[segHdrLen-csLen:])
+	if computed := xxh3.Hash(body); computed != sum {
+		return segmentHeader{}, fmt.Errorf("%w: %w: expected %x, got %x",
+			ErrBadSegmentHeader, ErrChecksumMismatch, sum, computed)
+	}
+
+	h := segmentHeader{
+		version:      binary.LittleEndian.Uint16(body[8:]),
+		checksumAlgo: body[10],
+		flags:        body[11],
+		createdAt:    time.Unix(0, int64(binary.LittleEndian.Uint64(body[16:]))),
+	}
+
+	if h.version == 0 || h.version > segmentVersion {
+		return segmentHeader{}, fmt.Errorf("%w: unsupported version %d", ErrBadSegmentHeader, h.version)
+	}
+
+	if h.checksumAlgo != checksumXXH3 {
+		return segmentHeader{}, fmt.Errorf("%w: unsupported checksum algorithm %d", ErrBadSegmentHeader, h.checksumAlgo)
+	}
+
+	return h, nil
+}
+
+// rewriteSegmentHeader replaces everything in f with the header h
+func rewriteSegmentHeader(f *os.File, h segmentHeader) error {
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("truncate segment: %w", err)
+	}
+	if _, err := f.WriteAt(h.encode(), 0); err != nil {
+		return fmt.Errorf("write segment header: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync segment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package core
+
+// Stats is a snapshot of database statistics
+type Stats struct {
+	Segments   int   // number of segments, including the active one
+	Keys       int   // number of live keys in the index
+	Tombstones int   // number of tombstones tracked for merge
+	IndexBytes int64 // estimated memory used by the index and the tombstones
+
+	IndexDiskBytes int64 // size of the disk index files, 0 unless WithDiskIndex is used
+
+	CacheHits   int64 // Gets served from the value cache
+	CacheMisses int64 // Gets that missed the value cache, 0 unless WithValueCache is used
+	CacheBytes  int64 // estimated memory used by the value cache
+
+	ScrubPasses      int64 // completed scrub passes
+	ScrubBytes       int64 // bytes verified by the scrubber
+	ScrubCorruptions int64 // corrupted records found by the scrubber
+}
+
+// Stats returns the current statistics of the database
+func (db *DB) Stats() Stats {
+	db.rw.RLock()
+	defer db.rw.RUnlock()
+
+	hits, misses, cacheBytes := db.valueCache.stats()
+
+	return Stats{
+		Segments:   len(db.segments),
+		Keys:       db.index.len(),
+		Tombstones: db.tombstones.len(),
+		IndexBytes: db.index.memoryUsage() + db.tombstones.memoryUsage(),
+
+		IndexDiskBytes: db.index.diskUsage() + db.tombstones.diskUsage(),
+
+		CacheHits:   hits,
+		CacheMisses: misses,
+		CacheBytes:  cacheBytes,
+
+		ScrubPasses:      db.scrubStats.passes.Load(),
+		ScrubBytes:       db.scrubStats.bytes.Load(),
+		ScrubCorruptions: db.scrubStats.corruptions.Load(),
+	}
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// VerifyReport is the outcome of Verify
+type VerifyReport struct {
+	Segments int     // segments listed in the MANIFEST
+	Records  int64   // valid records in those segments
+	Keys     int     // live keys in the index rebuilt from the records
+	Problems []error // everything that's wrong with the data directory
+}
+
+// OK reports whether Verify found no problems
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+var errOrphanedSegment = errors.New("segment is not in the manifest")
+
+// Verify runs a full integrity check of the database in dir without modifying
+// it. It checks that the MANIFEST is intact, that the listed segments exist and
+// no others do, that every record has a valid checksum and the segments aren't
+// truncated, and that the index can be rebuilt, agreeing with the checkpoint
+// if there's one that Open would use. Problems are listed in the report, the
+// returned error is only for failures to run the check.
+func Verify(dir string) (*VerifyReport, error) {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &VerifyReport{}
+	problem := func(format string, args ...any) {
+		rep.Problems = append(rep.Problems, fmt.Errorf(format, args...))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		problem("read manifest: %w", err)
+		return rep, nil
+	}
+
+	st, err := parseManifest(data)
+	if err != nil {
+		problem("%w", err)
+		return rep, nil
+	}
+	if !st.legacy && st.end < int64(len(data)) {
+		problem("%w: torn edit at %d", ErrManifestCorrupt, st.end)
+	}
+
+	rep.Segments = len(st.segs)
+
+	// rebuild the index the way Open does, remembering the records of
+	// the active segment in case they're replayed on top of a checkpoint
+	index, tombstones := newMemKeydir(), newMemKeydir()
+	var activeRecs []*scannedRecord
+
+	for i, m := range st.segs {
+		name, ok := files[m.id]
+		if !ok {
+			problem("segment %d: %w", m.id, os.ErrNotExist)
+			continue
+		}
+
+		recs, err := verifySegment(filepath.Join(dir, name), m, problem)
+		if err != nil {
+			return nil, fmt.Errorf("verify segment %d: %w", m.id, err)
+		}
+		rep.Records += int64(len(recs))
+
+		replayRecords(m.id, recs, index, tombstones)
+		if i == len(st.segs)-1 {
+			activeRecs = recs
+		}
+	}
+
+	rep.Keys = index.len()
+
+	listed := st.ids()
+	for _, id := range slices.Sorted(maps.Keys(files)) {
+		if !slices.Contains(listed, id) {
+			problem("%s: %w", files[id], errOrphanedSegment)
+		}
+	}
+
+	if err := verifyCheckpoint(dir, listed, activeRecs, index, tombstones, problem); err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
+
+// verifySegment checks the segment file at path against its manifest entry and
+// returns its valid records. Problems are reported through problem.
+func verifySegment(path string, m segmentMeta, problem func(string, ...any)) ([]*scannedRecord, error) {
+	var recs []*scannedRecord
+
+	err := withSegmentFile(filepath.Dir(path), filepath.Base(path), func(f *os.File, hdr segmentHeader, size int64) error {
+		if m.sealed() && size != m.size {
+			problem("segment %d: size is %d, manifest says %d", m.id, size, m.size)
+		}
+
+		off := hdr.len()
+		for off < size {
+			rs := newRecordScannerRange(f, off, size, true)
+			for rs.scan() {
+				if wt := rs.record.wt; wt != TypeSet && wt != TypeDelete {
+					problem("segment %d: record at %d has unknown write type %d", m.id, rs.record.off, wt)
+					continue
+				}
+				recs = append(recs, rs.record)
+			}
+
+			if rs.err == nil && rs.end == size {
+				break
+			}
+			if rs.err != nil && !errors.Is(rs.err, ErrChecksumMismatch) && !errors.Is(rs.err, errRecordOutOfRange) {
+				return rs.err
+			}
+
+			lostAt := rs.end
+			if errors.Is(rs.err, ErrChecksumMismatch) {
+				lostAt = rs.off
+			}
+
+			next, err := findNextRecord(f, lostAt, size)
+			if err != nil {
+				return err
+			}
+
+			if rs.err == nil && next == size {
+				problem("segment %d: truncated record at %d", m.id, lostAt)
+			} else {
+				problem("segment %d: corrupted bytes [%d, %d): %w", m.id, lostAt, next, cmp.Or(rs.err, errRecordOutOfRange))
+			}
+			off = next
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		if errors.Is(err, ErrBadSegmentHeader) {
+			problem("segment %d: %w", m.id, err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if m.sealed() && int64(len(recs)) != m.records {
+		problem("segment %d: has %d records, manifest says %d", m.id, len(recs), m.records)
+	}
+
+	return recs, nil
+}
+
+// verifyCheckpoint compares the checkpoint to the index rebuilt from the segments.
+// A checkpoint that Open would ignore is fine, it's only a problem if Open would
+// use it and end up with a different index.
+func verifyCheckpoint(dir string, segIds []int, activeRecs []*scannedRecord,
+	index, tombstones keydir, problem func(string, ...any)) error {
+	data, err := os.ReadFile(filepath.Join(dir, checkpointName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read checkpoint: %w", err)
+	}
+
+	r, segs, err := parseCheckpoint(data)
+	if err == nil {
+		err = validateCheckpoint(dir, segs, segIds)
+	}
+	if err != nil {
+		return nil
+	}
+
+	byId := make(map[int]*segment, len(segs))
+	for _, cs := range segs {
+		byId[cs.id] = &segment{id: cs.id, size: cs.size}
+	}
+
+	cpIndex, cpTombstones := newMemKeydir(), newMemKeydir()
+	err = readCheckpointLocations(r, byId, cpIndex)
+	if err == nil {
+		err = readCheckpointLocations(r, byId, cpTombstones)
+	}
+	if err != nil {
+		problem("checkpoint: %w", err)
+		return nil
+	}
+
+	// Open replays the records appended to the active segment after the checkpoint
+	active := segs[len(segs)-1]
+	replayRecords(active.id, slices.DeleteFunc(slices.Clone(activeRecs), func(rec *scannedRecord) bool {
+		return rec.off < active.size
+	}), cpIndex, cpTombstones)
+
+	compareKeydirs("index", index, cpIndex, problem)
+	compareKeydirs("tombstones", tombstones, cpTombstones, problem)
+
+	return nil
+}
+
+// compareKeydirs reports the keys that the checkpoint got wrong
+func compareKeydirs(name string, want, got keydir, problem func(string, ...any)) {
+	want.forEach(func(key string, loc recordLocation) bool {
+		if cpLoc, ok := got.get(key); !ok || cpLoc != loc {
+			problem("checkpoint %s: key %q is at %d:%d, segments say %d:%d",
+				name, key, cpLoc.segId, cpLoc.offset, loc.segId, loc.offset)
+		}
+		return true
+	})
+
+	got.forEach(func(key string, _ recordLocation) bool {
+		if _, ok := want.get(key); !ok {
+			problem("checkpoint %s: key %q is not in the segments", name, key)
+		}
+		return true
+	})
+}
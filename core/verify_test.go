@@ -0,0 +1,108 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	setup := func(t *testing.T) string {
+		db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false), WithCheckpoint(true))
+		_ = db.Set("a", "1")
+		_ = db.Set("b", "2")
+		_ = db.Delete("a")
+		_ = db.Close()
+		return dir
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		dir := setup(t)
+
+		rep, err := Verify(dir)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		if !rep.OK() || rep.Segments != 4 || rep.Records != 3 || rep.Keys != 1 {
+			t.Fatalf("unexpected report: %+v", rep)
+		}
+	})
+
+	// value sizes in the checkpoint don't count the record timestamps
+	t.Run("timestamps", func(t *testing.T) {
+		db, dir, _ := SetupTempDB(t, WithRolloverThreshold(1), WithMergeEnabled(false), WithCheckpoint(true), WithTimestamps(true))
+		_ = db.Set("a", "1")
+		_ = db.Set("b", "2")
+		_ = db.Delete("a")
+		if err := db.merge(); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+		_ = db.Set("c", "3")
+		_ = db.Delete("b")
+		_ = db.Close()
+
+		rep, err := Verify(dir)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		if !rep.OK() || rep.Keys != 1 {
+			t.Fatalf("unexpected report: %+v", rep)
+		}
+	})
+
+	for _, tc := range []struct {
+		name   string
+		damage func(dir string)
+		want   error
+	}{
+		{"checksum", func(dir string) {
+			corruptAt(t, getSegmentPath(dir, 2), segHdrLen+hdrLen+1)
+		}, ErrChecksumMismatch},
+		{"truncated", func(dir string) {
+			_ = os.Truncate(getSegmentPath(dir, 1), segHdrLen+hdrLen)
+		}, nil},
+		{"missing segment", func(dir string) {
+			_ = os.Remove(getSegmentPath(dir, 2))
+		}, os.ErrNotExist},
+		{"orphan", func(dir string) {
+			_ = os.WriteFile(getSegmentPath(dir, 9), nil, 0o644)
+		}, errOrphanedSegment},
+		{"manifest", func(dir string) {
+			corruptAt(t, filepath.Join(dir, manifestName), manifestHdrLen+manifestFrameLen+1)
+		}, ErrManifestCorrupt},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := setup(t)
+			tc.damage(dir)
+
+			rep, err := Verify(dir)
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if rep.OK() {
+				t.Fatalf("expected problems")
+			}
+			if tc.want != nil && !errors.Is(rep.Problems[0], tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, rep.Problems)
+			}
+		})
+	}
+
+	// a checkpoint that Open would use must match the segments
+	t.Run("checkpoint", func(t *testing.T) {
+		db, dir, _ := SetupTempDB(t, WithMergeEnabled(false), WithCheckpoint(true))
+		_ = db.Set("a", "1")
+		_ = db.Set("b", "2")
+		db.index.delete("b")
+		_ = db.Close()
+
+		rep, err := Verify(dir)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		if len(rep.Problems) != 1 {
+			t.Fatalf("expected the missing key to be reported, got %v", rep.Problems)
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// WithTimestamps stores the write time in each record, for History. Records
+// get 8 bytes longer, and versions that predate timestamps can't read them.
+func WithTimestamps(b bool) Option {
+	return func(db *DB) { db.timestamps = b }
+}
+
+// WithMergeKeepVersions makes merge keep the n most recent versions of each
+// key, the latest one included, instead of only the latest one. Deletions
+// between kept versions are kept too. Versions of deleted keys are dropped in
+// any case.
+func WithMergeKeepVersions(n int) Option {
+	return func(db *DB) { db.keepVersions = n }
+}
+
+// WithMergeKeepFor makes merge keep the versions written in the last d, in
+// addition to the ones WithMergeKeepVersions keeps. It needs WithTimestamps,
+// versions without a timestamp are considered old.
+func WithMergeKeepFor(d time.Duration) Option {
+	return func(db *DB) { db.keepVersionsFor = d }
+}
+
+// Version is a value a key had
+type Version struct {
+	Value   string
+	Time    time.Time // write time, zero if the record was written without WithTimestamps
+	Deleted bool      // the key was deleted, there's no value
+}
+
+// writeTime returns the timestamp of a record written now, 0 for no timestamp
+func (db *DB) writeTime() int64 {
+	if !db.timestamps {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// History returns up to n versions of key, newest first, starting with the
+// current one. It returns none for n <= 0. Older versions are the ones in segments that aren't merged yet,
+// and the ones merge keeps with WithMergeKeepVersions or WithMergeKeepFor. It
+// scans the segments, so it's meant for auditing rather than regular reads.
+func (db *DB) History(key string, n int) ([]Version, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	// segments are scanned newest first, merges don't remove them meanwhile
+	view := db.pinSegments()
+	defer db.unpinSegments()
+
+	var versions []Version
+	for i := len(view.metas) - 1; i >= 0 && len(versions) < n; i-- {
+		m := view.metas[i]
+
+		end := m.size
+		if !m.sealed() {
+			end = view.activeSize
+		}
+
+		found, err := db.segmentVersions(m.id, end, key)
+		if err != nil {
+			return nil, err
+		}
+
+		slices.Reverse(found)
+		versions = append(versions, found...)
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+
+	return versions[:min(n, len(versions))], nil
+}
+
+// segmentVersions returns the versions of key in the first end bytes of a segment, oldest first
+func (db *DB) segmentVersions(id int, end int64, key string) ([]Version, error) {
+	f, err := os.Open(getSegmentPath(db.dir, id))
+	if err != nil {
+		return nil, fmt.Errorf("open segment %d: %w", id, err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	hdr, err := readSegmentHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("segment %d: %w", id, err)
+	}
+
+	var versions []Version
+	rs := newRecordScannerRange(f, hdr.len(), end, db.checksumEnabled)
+	for rs.scanHeader() {
+		if string(rs.key) != key {
+			continue
+		}
+
+		if !rs.readValue() {
+			break
+		}
+
+		val, ts, err := splitValue(rs.raw(), len(rs.key))
+		if err != nil {
+			return nil, fmt.Errorf("segment %d at %d: %w", id, rs.off, err)
+		}
+		versions = append(versions, Version{Value: string(val), Time: ts, Deleted: rs.wt == TypeDelete})
+	}
+
+	if rs.err != nil {
+		return nil, fmt.Errorf("scan segment %d: %w", id, rs.err)
+	}
+
+	return versions, nil
+}
+
+// keyVersions holds back the older records of a key during a merge that keeps
+// versions, so they're written right before the latest one
+type keyVersions struct {
+	recent   []versionRecord // records after the last set that fell out, up to keepVersions-1 sets
+	sets     int             // sets in recent
+	lastKept bool            // the last set that fell out was kept for WithMergeKeepFor
+}
+
+// versionRecord is an older record of a key in the merge input
+type versionRecord struct {
+	seg *segment
+	off int64
+	wt  WriteType
+}
+
+// keepingVersions reports whether merge keeps more than the latest version of keys
+func (db *DB) keepingVersions() bool {
+	return db.keepVersions > 1 || db.keepVersionsFor > 0
+}
+
+// mergeVersion handles an older record of a live key. The records of the
+// keepVersions-1 most recent older values are held back, values that fall out
+// are written right away if WithMergeKeepFor keeps them. Deletions are kept
+// when they're between kept versions, so History shows them.
+func (db *DB) mergeVersion(out *mergeOutput, seg *segment, rs *recordScanner) error {
+	key := string(rs.key)
+	kv := out.versions[key]
+	if kv == nil {
+		kv = &keyVersions{}
+		out.versions[key] = kv
+	}
+
+	kv.recent = append(kv.recent, versionRecord{seg: seg, off: rs.off, wt: rs.wt})
+	if rs.wt != TypeSet {
+		return nil
+	}
+	kv.sets++
+
+	for kv.sets > max(db.keepVersions-1, 0) {
+		r := kv.recent[0]
+		kv.recent = kv.recent[1:]
+
+		if r.wt != TypeSet {
+			if kv.lastKept {
+				if err := db.copyVersion(out, r); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		kv.sets--
+
+		keep, err := db.copyYoungVersion(out, r)
+		if err != nil {
+			return err
+		}
+		kv.lastKept = keep
+	}
+
+	return nil
+}
+
+// flushVersions writes the records held back for key, they're all kept
+// except the deletions before the first kept value
+func (db *DB) flushVersions(out *mergeOutput, key string) error {
+	kv := out.versions[key]
+	if kv == nil {
+		return nil
+	}
+	delete(out.versions, key)
+
+	kept := kv.lastKept
+	for _, r := range kv.recent {
+		if r.wt == TypeSet {
+			kept = true
+		}
+		if !kept {
+			continue
+		}
+		if err := db.copyVersion(out, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyYoungVersion copies a record if it's written in the last keepVersionsFor
+func (db *DB) copyYoungVersion(out *mergeOutput, r versionRecord) (bool, error) {
+	if db.keepVersionsFor <= 0 {
+		return false, nil
+	}
+
+	raw, err := readRawRecord(r.seg.file, r.off)
+	if err != nil {
+		return false, fmt.Errorf("read segment %d at %d: %w", r.seg.id, r.off, err)
+	}
+
+	_, keyLen, _, _ := parseHeader([hdrLen]byte(raw))
+	_, ts, err := splitValue(raw, keyLen)
+	if err != nil || ts.IsZero() || time.Since(ts) >= db.keepVersionsFor {
+		return false, nil
+	}
+
+	_, err = db.writeMergeRecord(out, raw)
+	return true, err
+}
+
+func (db *DB) copyVersion(out *mergeOutput, r versionRecord) error {
+	raw, err := readRawRecord(r.seg.file, r.off)
+	if err != nil {
+		return fmt.Errorf("read segment %d at %d: %w", r.seg.id, r.off, err)
+	}
+
+	_, err = db.writeMergeRecord(out, raw)
+	return err
+}
+
+// readRawRecord reads the encoded bytes of the record at off
+func readRawRecord(r io.ReaderAt, off int64) ([]byte, error) {
+	var hdr [hdrLen]byte
+	if _, err := r.ReadAt(hdr[:], off); err != nil {
+		return nil, err
+	}
+
+	_, keyLen, valLen, _ := parseHeader(hdr)
+	raw := make([]byte, hdrLen+keyLen+valLen)
+	if _, err := r.ReadAt(raw, off); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
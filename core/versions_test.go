@@ -0,0 +1,117 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func checkHistory(t *testing.T, db *DB, key string, want ...string) {
+	t.Helper()
+
+	versions, err := db.History(key, 10)
+	if err != nil {
+		t.Fatalf("history of %s: %v", key, err)
+	}
+
+	var got []string
+	for _, v := range versions {
+		if v.Deleted {
+			got = append(got, "<deleted>")
+		} else {
+			got = append(got, v.Value)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected history of %s to be %v, got %v", key, want, got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithRolloverThreshold(50), WithMergeEnabled(false), WithTimestamps(true))
+	start := time.Now()
+
+	_ = db.Set("a", "1")
+	_ = db.Set("b", "1")
+	_ = db.Set("a", "2")
+	_ = db.Delete("a")
+	_ = db.Set("a", "3")
+
+	checkHistory(t, db, "a", "3", "<deleted>", "2", "1")
+
+	versions, err := db.History("a", 2)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %v, %v", versions, err)
+	}
+	if v := versions[1]; v.Time.Before(start) || !v.Time.Before(versions[0].Time) {
+		t.Fatalf("expected write times, newest first, got %v", versions)
+	}
+
+	// timestamps are stripped from values
+	if v, err := db.Get("a"); err != nil || v != "3" {
+		t.Fatalf("expected a=3, got %q, %v", v, err)
+	}
+
+	if versions, err := db.History("a", 0); err != nil || len(versions) != 0 {
+		t.Fatalf("expected no versions, got %v, %v", versions, err)
+	}
+
+	if _, err := db.History("missing", 10); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected key not found, got %v", err)
+	}
+}
+
+func TestMergeKeepVersions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{"latest", nil, []string{"4"}},
+		{"last 2", []Option{WithMergeKeepVersions(2)}, []string{"4", "3"}},
+		{"last 3", []Option{WithMergeKeepVersions(3)}, []string{"4", "3", "<deleted>", "2"}},
+		{"younger than", []Option{WithMergeKeepFor(time.Hour)}, []string{"4", "3", "<deleted>", "2", "1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]Option{WithRolloverThreshold(1), WithMergeEnabled(false), WithTimestamps(true)}, tc.opts...)
+			db, dir, _ := SetupTempDB(t, opts...)
+
+			for i := 1; i <= 4; i++ {
+				_ = db.Set("a", fmt.Sprint(i))
+				if i == 2 {
+					_ = db.Delete("a")
+				}
+			}
+			_ = db.Set("b", "1")
+			_ = db.Set("b", "2")
+			_ = db.Delete("b")
+
+			if err := db.merge(); err != nil {
+				t.Fatalf("merge: %v", err)
+			}
+
+			checkHistory(t, db, "a", tc.want...)
+
+			// versions of deleted keys are dropped
+			if _, err := db.History("b", 10); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("expected no versions of b, got %v", err)
+			}
+
+			// the latest version wins on replay
+			_ = db.Close()
+			db, err := Open(dir, opts...)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer db.Close() // nolint:errcheck
+
+			if v, err := db.Get("a"); err != nil || v != "4" {
+				t.Fatalf("expected a=4, got %q, %v", v, err)
+			}
+			if _, err := db.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("expected b to stay deleted, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Watchers get the writes as events. Writes push them to a bounded queue per
+// watcher while holding the db lock, and a goroutine delivers the queue, so a
+// slow consumer never blocks writes. When a queue is full, its watcher is
+// dropped: it delivers what's queued and ends with ErrWatchOverflow, and the
+// consumer can pick up where it left with WatchFrom.
+//
+// The sequence of an event is the position of its record, its segment and
+// offset. Segment ids grow and merges don't produce events, so the sequences
+// of a stream only grow, and WatchFrom can find a sequence again as long as
+// its segment isn't merged.
+
+var ErrWatchOverflow = errors.New("watch buffer overflow")
+var ErrSequenceMerged = errors.New("sequence merged away")
+
+const defaultWatchBuffer = 1024
+
+// WithWatchBuffer sets how many events a watcher queues before it overflows
+func WithWatchBuffer(n int) Option {
+	return func(db *DB) { db.watchBuffer = n }
+}
+
+// Event is a write delivered by a Watcher
+type Event struct {
+	Type  WriteType
+	Key   string
+	Value string // empty for TypeDelete
+	Seq   Seq
+}
+
+// Seq is the position of an event's record. The zero Seq is before all writes.
+type Seq struct {
+	Segment int
+	Offset  int64
+}
+
+// Compare returns -1, 0 or 1 as s is before, at or after o in a stream
+func (s Seq) Compare(o Seq) int {
+	if c := cmp.Compare(s.Segment, o.Segment); c != 0 {
+		return c
+	}
+	return cmp.Compare(s.Offset, o.Offset)
+}
+
+// Watcher is a stream of the writes to keys with a prefix
+type Watcher struct {
+	events chan Event
+	queue  chan Event // live events, closed when the watcher is dropped
+	prefix string
+	cause  error // why the watcher was dropped, set before queue is closed
+	err    error // set before events is closed
+}
+
+// Events returns the stream, it's closed when the watcher ends
+func (w *Watcher) Events() <-chan Event { return w.events }
+
+// Err returns why the watcher ended, once Events is closed: the context
+// error, ErrWatchOverflow, os.ErrClosed if the db is closed, or a read error
+// of WatchFrom.
+func (w *Watcher) Err() error { return w.err }
+
+// Watch streams the writes to keys with prefix from now on, until ctx is done
+func (db *DB) Watch(ctx context.Context, prefix string) (*Watcher, error) {
+	return db.watch(ctx, prefix, Seq{}, false)
+}
+
+// WatchFrom is Watch that first replays the writes after seq from the
+// segments. It fails with ErrSequenceMerged if a merge has compacted writes
+// after seq. The zero Seq replays the writes since the last merge, the ones
+// a merge compacted are only in the current values.
+func (db *DB) WatchFrom(ctx context.Context, prefix string, seq Seq) (*Watcher, error) {
+	return db.watch(ctx, prefix, seq, true)
+}
+
+func (db *DB) watch(ctx context.Context, prefix string, seq Seq, replay bool) (*Watcher, error) {
+	w := &Watcher{
+		events: make(chan Event),
+		queue:  make(chan Event, db.watchBuffer),
+		prefix: prefix,
+	}
+
+	// the replay ends where the live events start
+	var metas []segmentMeta
+	var activeSize int64
+
+	db.rw.Lock()
+	if replay {
+		view := db.pinSegmentsLocked()
+		var err error
+		if metas, err = replaySegments(view.metas, seq); err != nil {
+			db.rw.Unlock()
+			db.unpinSegments()
+			return nil, err
+		}
+		activeSize = view.activeSize
+	}
+	db.watchers = append(db.watchers, w)
+	db.rw.Unlock()
+
+	go func() {
+		defer close(w.events)
+
+		var err error
+		if replay {
+			err = db.replay(ctx, w, metas, activeSize, seq)
+			db.unpinSegments()
+		}
+		if err == nil {
+			err = w.forward(ctx)
+		}
+
+		db.rw.Lock()
+		db.dropWatcher(w, err)
+		db.rw.Unlock()
+
+		w.err = err
+	}()
+
+	return w, nil
+}
+
+// forward delivers the live events until the watcher is dropped
+func (w *Watcher) forward(ctx context.Context) error {
+	for {
+		select {
+		case ev, ok := <-w.queue:
+			if !ok {
+				return w.cause
+			}
+			if err := w.send(ctx, ev); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *Watcher) send(ctx context.Context, ev Event) error {
+	select {
+	case w.events <- ev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// replaySegments returns the segments that hold the writes after seq
+func replaySegments(metas []segmentMeta, seq Seq) ([]segmentMeta, error) {
+	// the zero seq starts after the merged segments, they're always the oldest
+	i := 0
+	if seq == (Seq{}) {
+		for i < len(metas) && metas[i].flags&metaMerged != 0 {
+			i++
+		}
+	} else {
+		i = slices.IndexFunc(metas, func(m segmentMeta) bool { return m.id == seq.Segment })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: segment %d is gone", ErrSequenceMerged, seq.Segment)
+		}
+	}
+
+	// merged segments hold compacted writes, they're not a history
+	for _, m := range metas[i:] {
+		if m.flags&metaMerged != 0 {
+			return nil, fmt.Errorf("%w: segment %d is merged", ErrSequenceMerged, m.id)
+		}
+	}
+
+	return metas[i:], nil
+}
+
+// replay sends the writes after seq in the segments, the active one is read up to activeSize
+func (db *DB) replay(ctx context.Context, w *Watcher, metas []segmentMeta, activeSize int64, seq Seq) error {
+	for _, m := range metas {
+		end := m.size
+		if !m.sealed() {
+			end = activeSize
+		}
+
+		if err := db.replaySegment(ctx, w, m.id, end, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) replaySegment(ctx context.Context, w *Watcher, id int, end int64, seq Seq) error {
+	f, err := os.Open(getSegmentPath(db.dir, id))
+	if err != nil {
+		return fmt.Errorf("open segment %d: %w", id, err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	hdr, err := readSegmentHeader(f)
+	if err != nil {
+		return fmt.Errorf("segment %d: %w", id, err)
+	}
+
+	rs := newRecordScannerRange(f, hdr.len(), end, db.checksumEnabled)
+	for rs.scanHeader() {
+		recSeq := Seq{Segment: id, Offset: rs.off}
+		if recSeq.Compare(seq) <= 0 || !strings.HasPrefix(string(rs.key), w.prefix) {
+			continue
+		}
+
+		if !rs.readValue() {
+			break
+		}
+
+		val, _, err := splitValue(rs.raw(), len(rs.key))
+		if err != nil {
+			return fmt.Errorf("segment %d at %d: %w", id, rs.off, err)
+		}
+
+		ev := Event{Type: rs.wt, Key: string(rs.key), Value: string(val), Seq: recSeq}
+		if err := w.send(ctx, ev); err != nil {
+			return err
+		}
+	}
+
+	if rs.err != nil {
+		return fmt.Errorf("scan segment %d: %w", id, rs.err)
+	}
+
+	return nil
+}
+
+// notify queues a write for the watchers of its key, the ones
+// whose queue is full are dropped. Caller must hold the db lock.
+func (db *DB) notify(wt WriteType, key, val string, id int, off int64) {
+	if len(db.watchers) == 0 {
+		return
+	}
+
+	ev := Event{Type: wt, Key: key, Value: val, Seq: Seq{Segment: id, Offset: off}}
+
+	kept := db.watchers[:0]
+	for _, w := range db.watchers {
+		if !strings.HasPrefix(key, w.prefix) {
+			kept = append(kept, w)
+			continue
+		}
+
+		select {
+		case w.queue <- ev:
+			kept = append(kept, w)
+		default:
+			w.cause = ErrWatchOverflow
+			close(w.queue)
+		}
+	}
+
+	clear(db.watchers[len(kept):])
+	db.watchers = kept
+}
+
+// dropWatcher stops queueing events for w, if it's
+// still registered. Caller must hold the db lock.
+func (db *DB) dropWatcher(w *Watcher, cause error) {
+	i := slices.Index(db.watchers, w)
+	if i < 0 {
+		return
+	}
+
+	db.watchers = slices.Delete(db.watchers, i, i+1)
+	w.cause = cause
+	close(w.queue)
+}
+
+// closeWatchers drops all watchers, caller must hold the db lock
+func (db *DB) closeWatchers() {
+	for _, w := range db.watchers {
+		w.cause = os.ErrClosed
+		close(w.queue)
+	}
+	db.watchers = nil
+}
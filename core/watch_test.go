@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// nextEvents reads n events from w, failing the test if they don't arrive
+func nextEvents(t *testing.T, w *Watcher, n int) []Event {
+	t.Helper()
+
+	var evs []Event
+	for len(evs) < n {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("watch ended after %d events: %v", len(evs), w.Err())
+			}
+			evs = append(evs, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events", len(evs))
+		}
+	}
+	return evs
+}
+
+func eventString(evs []Event) string {
+	var s string
+	for _, ev := range evs {
+		s += fmt.Sprintf("%s %s=%s;", ev.Type, ev.Key, ev.Value)
+	}
+	return s
+}
+
+func TestWatch(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithRolloverThreshold(50), WithMergeEnabled(false))
+	_ = db.Set("user/old", "x")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := db.Watch(ctx, "user/")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	_ = db.Set("user/a", "1")
+	_ = db.Set("other", "x")
+	_ = db.Set("user/b", "2")
+	_ = db.Delete("user/a")
+
+	evs := nextEvents(t, w, 3)
+	if got, want := eventString(evs), fmt.Sprintf("%s user/a=1;%s user/b=2;%s user/a=;", TypeSet, TypeSet, TypeDelete); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	for i := 1; i < len(evs); i++ {
+		if evs[i].Seq.Compare(evs[i-1].Seq) <= 0 {
+			t.Fatalf("expected growing sequences, got %v", evs)
+		}
+	}
+
+	cancel()
+	for range w.Events() {
+	}
+	if !errors.Is(w.Err(), context.Canceled) {
+		t.Fatalf("expected the watch to be canceled, got %v", w.Err())
+	}
+}
+
+func TestWatchFrom(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithRolloverThreshold(50), WithMergeEnabled(false))
+	ctx := context.Background()
+
+	for i := range 5 {
+		_ = db.Set(fmt.Sprint("k", i), fmt.Sprint(i))
+	}
+
+	all, err := db.WatchFrom(ctx, "", Seq{})
+	if err != nil {
+		t.Fatalf("watch from the start: %v", err)
+	}
+	evs := nextEvents(t, all, 5)
+
+	// resumes after the second event, then goes on with the live ones
+	w, err := db.WatchFrom(ctx, "", evs[1].Seq)
+	if err != nil {
+		t.Fatalf("watch from %v: %v", evs[1].Seq, err)
+	}
+	_ = db.Set("k5", "5")
+
+	want := "set k2=2;set k3=3;set k4=4;set k5=5;"
+	if got := eventString(nextEvents(t, w, 4)); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	if err := db.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if _, err := db.WatchFrom(ctx, "", evs[1].Seq); !errors.Is(err, ErrSequenceMerged) {
+		t.Fatalf("expected the sequence to be merged away, got %v", err)
+	}
+
+	// the zero seq replays the writes since the merge
+	_ = db.Set("k6", "6")
+	since, err := db.WatchFrom(ctx, "", Seq{})
+	if err != nil {
+		t.Fatalf("watch from the start after a merge: %v", err)
+	}
+	if got := eventString(nextEvents(t, since, 1)); got != "set k6=6;" {
+		t.Fatalf("expected set k6=6;, got %s", got)
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	db, _, _ := SetupTempDB(t, WithWatchBuffer(2))
+
+	w, err := db.Watch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	// nobody reads, writes aren't blocked
+	for i := range 10 {
+		_ = db.Set(fmt.Sprint("k", i), "v")
+	}
+
+	var n int
+	for ev := range w.Events() {
+		if ev.Key != fmt.Sprint("k", n) {
+			t.Fatalf("expected k%d, got %s", n, ev.Key)
+		}
+		n++
+	}
+	if !errors.Is(w.Err(), ErrWatchOverflow) || n == 0 || n >= 10 {
+		t.Fatalf("expected an overflow after a few events, got %d events, %v", n, w.Err())
+	}
+}
+
+func TestWatchClose(t *testing.T) {
+	db, _, _ := SetupTempDB(t)
+
+	w, err := db.Watch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	_ = db.Set("a", "1")
+	_ = db.Close()
+
+	nextEvents(t, w, 1)
+	for range w.Events() {
+	}
+	if !errors.Is(w.Err(), os.ErrClosed) {
+		t.Fatalf("expected the watch to end with the db, got %v", w.Err())
+	}
+}
@@ -2,9 +2,9 @@ module github.com/epokhe/bitdb
 
 go 1.24.2
 
-require github.com/deckarep/golang-set/v2 v2.8.0
-
 require (
-	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
-	github.com/zeebo/xxh3 v1.0.2 // indirect
+	github.com/deckarep/golang-set/v2 v2.8.0
+	github.com/zeebo/xxh3 v1.0.2
 )
+
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect